@@ -0,0 +1,219 @@
+package logflect
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	DefaultAggregateEvery = 5 * time.Second
+	DefaultAggregateOver  = time.Minute
+	MinAggregateEvery     = time.Second
+	MaxAggregateOver      = time.Hour
+)
+
+// Rolling counts of the messages passing a filter, grouped by a field. The
+// window is split into buckets of `every`, the oldest of which is dropped
+// each time the window moves on.
+type aggregator struct {
+	by      string
+	every   time.Duration
+	over    time.Duration
+	buckets []map[string]int // oldest first; the last is current
+}
+
+// A single emission of an aggregation.
+type aggregateSnapshot struct {
+	DrainId string                    `json:"drain_id"`
+	At      time.Time                 `json:"at"`
+	By      string                    `json:"by,omitempty"`
+	Every   string                    `json:"every"`
+	Over    string                    `json:"over"`
+	Count   int                       `json:"count"`
+	Rate    float64                   `json:"rate"` // per second, over the window
+	Groups  map[string]aggregateGroup `json:"groups,omitempty"`
+}
+
+type aggregateGroup struct {
+	Count int     `json:"count"`
+	Rate  float64 `json:"rate"`
+}
+
+func newAggregator(by string, every, over time.Duration) *aggregator {
+	n := int((over + every - 1) / every)
+	a := &aggregator{by: by, every: every, over: over, buckets: make([]map[string]int, n)}
+	for i := range a.buckets {
+		a.buckets[i] = make(map[string]int)
+	}
+	return a
+}
+
+// Counts `m`, `age` ago. Messages older than the window are ignored.
+func (a *aggregator) add(m Message, age time.Duration) {
+	i := len(a.buckets) - 1 - int(age/a.every)
+	if age < 0 {
+		i = len(a.buckets) - 1
+	}
+	if i < 0 {
+		return
+	}
+	a.buckets[i][a.key(m)]++
+}
+
+// Returns the value `m` is grouped under, `-` if it has none.
+func (a *aggregator) key(m Message) string {
+	if a.by == "" {
+		return ""
+	}
+	if value, ok := fieldString(m, a.by); ok && value != "" {
+		return value
+	}
+	return "-"
+}
+
+// Moves the window on by one bucket.
+func (a *aggregator) rotate() {
+	copy(a.buckets, a.buckets[1:])
+	a.buckets[len(a.buckets)-1] = make(map[string]int)
+}
+
+func (a *aggregator) snapshot(drainId string, now time.Time) aggregateSnapshot {
+	snap := aggregateSnapshot{
+		DrainId: drainId,
+		At:      now.UTC(),
+		By:      a.by,
+		Every:   a.every.String(),
+		Over:    a.over.String(),
+	}
+
+	counts := make(map[string]int)
+	for _, bucket := range a.buckets {
+		for key, n := range bucket {
+			counts[key] += n
+			snap.Count += n
+		}
+	}
+
+	seconds := a.over.Seconds()
+	snap.Rate = float64(snap.Count) / seconds
+	if a.by != "" {
+		snap.Groups = make(map[string]aggregateGroup, len(counts))
+		for key, n := range counts {
+			snap.Groups[key] = aggregateGroup{Count: n, Rate: float64(n) / seconds}
+		}
+	}
+	return snap
+}
+
+// Streams an aggregation of a drain's messages, backed by a session.
+type Aggregation struct {
+	DrainId string
+	session *Session
+	ar      *aggregateRequest
+	agg     *aggregator
+	inbox   chan Message
+	after   uint64 // live messages up to this seq, if timestamped, were counted from the feed
+}
+
+// Starts aggregating `drainId`, counting messages already in its feed
+// which fall within the window. Close the aggregation's session with
+// DestroySession once done.
+func (s *Store) Aggregate(drainId string, ar *aggregateRequest) (*Aggregation, error) {
+	session, err := s.CreateSession(drainId, ar.filter)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Aggregation{
+		DrainId: drainId,
+		session: session,
+		ar:      ar,
+		agg:     newAggregator(ar.by, ar.every, ar.over),
+		inbox:   make(chan Message, MaxSessionChannelBacklog),
+	}
+	session.addChannel(a.inbox)
+
+	// Listening before scanning, so nothing falls in between; anything
+	// counted twice is skipped by seq.
+	if feed, exists := s.lookupFeed(drainId); exists {
+		now := time.Now()
+		feed.Scan(true, func(m Message) bool {
+			if seq, _ := messageSeq(m); seq > a.after {
+				a.after = seq
+			}
+			t, ok := messageTime(m)
+			if !ok {
+				return true
+			}
+			if now.Sub(t) >= ar.over {
+				return false
+			}
+			if ar.filter.Passes(m) {
+				a.agg.add(m, now.Sub(t))
+			}
+			return true
+		})
+	}
+
+	return a, nil
+}
+
+func (a *Aggregation) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.ar.sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	ticker := time.NewTicker(a.ar.every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg, open := <-a.inbox:
+			if !open {
+				return
+			}
+			// the scan counted what it could place by timestamp; the rest
+			// count now, as they're received
+			if seq, ok := messageSeq(msg); ok && seq <= a.after {
+				if _, timed := messageTime(msg); timed {
+					continue
+				}
+			}
+			a.agg.add(msg, 0)
+
+		case now := <-ticker.C:
+			if err := a.write(w, a.agg.snapshot(a.DrainId, now)); err != nil {
+				log.Printf("action=aggregate drainId=%s err=%q", a.DrainId, err)
+				return
+			}
+			a.agg.rotate()
+
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (a *Aggregation) write(w http.ResponseWriter, snap aggregateSnapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	if a.ar.sse {
+		_, err = fmt.Fprintf(w, "event: aggregate\ndata: %s\n\n", data)
+	} else {
+		_, err = fmt.Fprintf(w, "%s\n", data)
+	}
+	if err == nil {
+		w.(http.Flusher).Flush()
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package logflect
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAggregator_Snapshot(t *testing.T) {
+	agg := newAggregator("kv.status", 5*time.Second, 10*time.Second)
+	agg.add(StrMessage("status=200"), 0)
+	agg.add(StrMessage("status=500"), 0)
+	agg.add(StrMessage("status=200"), 6*time.Second)
+	agg.add(StrMessage("status=200"), 11*time.Second) // outside the window
+	agg.add(StrMessage("no status"), 0)
+
+	snap := agg.snapshot("drain.id", time.Now())
+	if snap.Count != 4 || snap.Rate != 0.4 {
+		t.Errorf("unexpected totals %d %f", snap.Count, snap.Rate)
+	}
+	if snap.Groups["200"].Count != 2 || snap.Groups["500"].Count != 1 || snap.Groups["-"].Count != 1 {
+		t.Errorf("unexpected groups %v", snap.Groups)
+	}
+
+	agg.rotate()
+	snap = agg.snapshot("drain.id", time.Now())
+	if snap.Count != 3 || snap.Groups["200"].Count != 1 {
+		t.Errorf("expected the oldest bucket to be dropped, found %d %v", snap.Count, snap.Groups)
+	}
+}
+
+func TestStore_Aggregate(t *testing.T) {
+	store := NewStore(time.Hour, time.Hour)
+	recent := time.Now().Add(-time.Second).UTC().Format(time.RFC3339Nano)
+	old := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)
+	store.Publish("drain.id", SyslogMessage{Time: []byte(old), Message: []byte("code=H12")})
+	store.Publish("drain.id", SyslogMessage{Time: []byte(recent), Message: []byte("code=H12")})
+	store.Publish("drain.id", SyslogMessage{Time: []byte(recent), Message: []byte("code=H10")})
+
+	ar := &aggregateRequest{filter: NewNoFilter(), by: "kv.code", every: 20 * time.Millisecond, over: time.Minute}
+	agg, err := store.Aggregate("drain.id", ar)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	store.Publish("drain.id", SyslogMessage{Time: []byte(recent), Message: []byte("code=H12")})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		agg.ServeHTTP(w, httptest.NewRequest("GET", "/v1/drains/drain.id/aggregate", nil).WithContext(ctx))
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+	store.DestroySession(agg.session.Id)
+
+	line, err := bufio.NewReader(w.Body).ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("expected a snapshot, found %q", w.Body.String())
+	}
+	var snap aggregateSnapshot
+	if err := json.Unmarshal(line, &snap); err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	if snap.Count != 3 || snap.Groups["H12"].Count != 2 || snap.Groups["H10"].Count != 1 {
+		t.Errorf("unexpected snapshot %+v", snap)
+	}
+}
+
+func TestStore_AggregateUntimed(t *testing.T) {
+	store := NewStore(time.Hour, time.Hour)
+	ar := &aggregateRequest{filter: NewNoFilter(), every: 20 * time.Millisecond, over: time.Minute}
+	agg, err := store.Aggregate("drain.id", ar)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	// arriving while the feed was scanned, so behind agg.after, but without
+	// a timestamp the scan could count it by
+	store.Publish("drain.id", SyslogMessage{Message: []byte("no time")})
+	agg.after = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		agg.ServeHTTP(w, httptest.NewRequest("GET", "/v1/drains/drain.id/aggregate", nil).WithContext(ctx))
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+	store.DestroySession(agg.session.Id)
+
+	var snap aggregateSnapshot
+	line, _ := bufio.NewReader(w.Body).ReadBytes('\n')
+	if err := json.Unmarshal(line, &snap); err != nil || snap.Count != 1 {
+		t.Errorf("expected the untimed message counted, found %+v (%v)", snap, err)
+	}
+}
@@ -0,0 +1,145 @@
+package logflect
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	DefaultAlertWindow   = time.Minute
+	DefaultAlertCooldown = 5 * time.Minute
+	DefaultAlertSamples  = 5
+	MaxAlertSamples      = 100
+	AlertTimeout         = 10 * time.Second
+)
+
+// When an alert session fires, and where to.
+type alertConfig struct {
+	url       *url.URL
+	threshold int // fire on more than this many matches within window
+	window    time.Duration
+	cooldown  time.Duration // minimum time between firings
+	samples   int           // number of recent matches sent along
+}
+
+// The JSON POSTed to an alert's webhook.
+type alertPayload struct {
+	SessionId string    `json:"session_id"`
+	DrainIds  []string  `json:"drain_ids,omitempty"`
+	Threshold int       `json:"threshold"`
+	Window    string    `json:"window"`
+	Count     int       `json:"count"`
+	FiredAt   time.Time `json:"fired_at"`
+	Samples   []Message `json:"samples"`
+}
+
+// Counts the messages passing a session's filter, and POSTs to a webhook
+// when more than the threshold arrive within the window. After firing it
+// stays quiet for the cooldown. Runs until the session is closed.
+type Alerter struct {
+	session   *Session
+	config    *alertConfig
+	client    *http.Client
+	inbox     chan Message
+	id        uint32
+	hits      []time.Time // arrival times of matches within the window
+	samples   []Message   // most recent matches, oldest first
+	lastFired time.Time
+	now       func() time.Time
+	done      chan struct{}
+}
+
+// Attaches an alerter to `session` and starts it.
+func StartAlerter(session *Session, config *alertConfig) *Alerter {
+	a := newAlerter(session, config)
+	go a.run()
+	return a
+}
+
+func newAlerter(session *Session, config *alertConfig) *Alerter {
+	a := &Alerter{
+		session: session,
+		config:  config,
+		client:  &http.Client{Timeout: AlertTimeout},
+		inbox:   make(chan Message, MaxSessionChannelBacklog),
+		now:     time.Now,
+		done:    make(chan struct{}),
+	}
+	a.id = session.addChannel(a.inbox)
+	return a
+}
+
+func (a *Alerter) run() {
+	defer close(a.done)
+	defer a.session.removeChannel(a.id)
+
+	for msg := range a.inbox {
+		if payload := a.record(msg); payload != nil {
+			a.fire(payload)
+		}
+	}
+}
+
+// Records a match, returning the payload to send if the alert should fire.
+func (a *Alerter) record(msg Message) *alertPayload {
+	now := a.now()
+
+	cutoff := now.Add(-a.config.window)
+	i := 0
+	for i < len(a.hits) && !a.hits[i].After(cutoff) {
+		i++
+	}
+	a.hits = append(a.hits[i:], now)
+
+	if a.samples = append(a.samples, msg); len(a.samples) > a.config.samples {
+		a.samples = a.samples[len(a.samples)-a.config.samples:]
+	}
+
+	if len(a.hits) <= a.config.threshold {
+		return nil
+	}
+	if !a.lastFired.IsZero() && now.Sub(a.lastFired) < a.config.cooldown {
+		return nil
+	}
+
+	a.lastFired = now
+	samples := make([]Message, len(a.samples))
+	copy(samples, a.samples)
+
+	return &alertPayload{
+		SessionId: a.session.Id,
+		DrainIds:  a.session.DrainIds,
+		Threshold: a.config.threshold,
+		Window:    a.config.window.String(),
+		Count:     len(a.hits),
+		FiredAt:   now.UTC(),
+		Samples:   samples,
+	}
+}
+
+func (a *Alerter) fire(payload *alertPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("action=alert session_id=%s err=%q", a.session.Id, err)
+		return
+	}
+
+	resp, err := a.client.Post(a.config.url.String(), "application/json", bytes.NewReader(body))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("Alert webhook returned %d", resp.StatusCode)
+		}
+	}
+
+	if err != nil {
+		log.Printf("action=alert session_id=%s count=%d err=%q", a.session.Id, payload.Count, err)
+	} else {
+		log.Printf("action=alert session_id=%s count=%d", a.session.Id, payload.Count)
+	}
+}
@@ -0,0 +1,84 @@
+package logflect
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAlerter_Record(t *testing.T) {
+	u, _ := url.Parse("http://example.com/hook")
+	session := NewSession("drain.id", NoFilter{})
+	a := newAlerter(session, &alertConfig{url: u, threshold: 2, window: time.Minute, cooldown: 5 * time.Minute, samples: 2})
+
+	now := time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)
+	a.now = func() time.Time { return now }
+
+	for _, line := range []string{"one", "two"} {
+		if a.record(StrMessage(line)) != nil {
+			t.Fatalf("fired before passing the threshold")
+		}
+	}
+
+	payload := a.record(StrMessage("three"))
+	if payload == nil {
+		t.Fatalf("expected to fire on the 3rd match")
+	}
+	if payload.Count != 3 || len(payload.Samples) != 2 || payload.Samples[1].String() != "three" {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+
+	// cooling down
+	now = now.Add(time.Minute - time.Second)
+	if a.record(StrMessage("four")) != nil {
+		t.Errorf("fired during cooldown")
+	}
+
+	// the earlier matches have left the window
+	now = now.Add(5 * time.Minute)
+	if a.record(StrMessage("five")) != nil {
+		t.Errorf("fired with only 1 match in the window")
+	}
+	a.record(StrMessage("six"))
+	if a.record(StrMessage("seven")) == nil {
+		t.Errorf("expected to fire again after cooldown")
+	}
+}
+
+func TestAlerter_Webhook(t *testing.T) {
+	var m sync.Mutex
+	var received []map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		m.Lock()
+		received = append(received, payload)
+		m.Unlock()
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	store := NewStore(time.Hour, time.Hour)
+	session, _ := store.CreateSession("drain.id", NewContainsFilter("message", "H12"))
+	a := StartAlerter(session, &alertConfig{url: u, threshold: 1, window: time.Minute, cooldown: time.Minute, samples: 1})
+
+	store.Publish("drain.id", StrMessage("at=error code=H12"))
+	store.Publish("drain.id", StrMessage("at=info"))
+	store.Publish("drain.id", StrMessage("at=error code=H12"))
+	store.Publish("drain.id", StrMessage("at=error code=H12"))
+	store.DestroySession(session.Id)
+	<-a.done
+
+	m.Lock()
+	defer m.Unlock()
+	if len(received) != 1 {
+		t.Fatalf("expected 1 alert, got %d", len(received))
+	}
+	if received[0]["session_id"] != session.Id || received[0]["count"] != float64(2) {
+		t.Errorf("unexpected alert %+v", received[0])
+	}
+}
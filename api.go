@@ -1,94 +1,358 @@
 package logflect
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/bmizerany/lpx"
 	"github.com/bmizerany/pat"
 )
 
+const (
+	ShutdownIngestTimeout = 10 * time.Second
+	ShutdownStreamTimeout = 5 * time.Second
+	MaxRelayErrorSize     = 4096 // bytes of a relayed response's body passed back
+)
+
+var (
+	ErrIngestTimeout = errors.New("Timed out waiting for ingest to finish")
+)
+
 type Api struct {
 	sync.WaitGroup
-	store        *Store
-	server       *http.Server
-	mux          *pat.PatternServeMux
-	shuttingDown bool
+	store   *Store
+	server  *http.Server
+	mux     *pat.PatternServeMux
+	cluster *Cluster      // nil unless running as part of a cluster
+	queue   *ingestQueue  // batches accepted, waiting to be published
+	closing chan struct{} // closed when the api stops accepting requests
+	m       *sync.Mutex   // orders counting ingest in against closing
 }
 
 func NewApi(store *Store, s *http.Server) *Api {
 	a := &Api{
-		store:  store,
-		server: s,
-		mux:    pat.New(),
+		store:   store,
+		server:  s,
+		mux:     pat.New(),
+		closing: make(chan struct{}),
+		m:       new(sync.Mutex),
 	}
+	a.queue = newIngestQueue(IngestWorkers, IngestQueueSize, a.publishBatch)
 
 	a.mux.Get("/v1/health", http.HandlerFunc(a.healthCheck))
+	a.mux.Get("/metrics", http.HandlerFunc(a.prometheusMetrics))
 
 	// Drain
 	a.mux.Post("/v1/logs", http.HandlerFunc(a.logs))
 
+	// Search
+	a.mux.Get("/v1/drains/:drain_id/logs", http.HandlerFunc(a.searchLogs))
+	a.mux.Get("/v1/drains/:drain_id/aggregate", http.HandlerFunc(a.aggregateLogs))
+	a.mux.Get("/v1/drains/:drain_id/metrics", http.HandlerFunc(a.drainMetrics))
+
+	// Ingest redactions
+	a.mux.Get("/v1/drains/:drain_id/redactions", http.HandlerFunc(a.getRedactions))
+	a.mux.Put("/v1/drains/:drain_id/redactions", http.HandlerFunc(a.setRedactions))
+	a.mux.Del("/v1/drains/:drain_id/redactions", http.HandlerFunc(a.deleteRedactions))
+
+	// Drain groups
+	a.mux.Get("/v1/groups/:name", http.HandlerFunc(a.getGroup))
+	a.mux.Put("/v1/groups/:name", http.HandlerFunc(a.setGroup))
+	a.mux.Del("/v1/groups/:name", http.HandlerFunc(a.deleteGroup))
+
 	// Sessions
+	a.mux.Head("/v1/sessions/:session_id", http.HandlerFunc(a.headSession))
 	a.mux.Get("/v1/sessions/:session_id", http.HandlerFunc(a.serveSession))
 	a.mux.Del("/v1/sessions/:session_id", http.HandlerFunc(a.deleteSession))
 	a.mux.Post("/v1/sessions", http.HandlerFunc(a.newSession))
 
-	s.Handler = a.mux
+	s.Handler = a
 	return a
 }
 
+// Shares drains with the other nodes of `c`: ingest and sessions for drains
+// owned by another node are relayed or redirected to it.
+func (s *Api) SetCluster(c *Cluster) {
+	s.cluster = c
+}
+
 func (s *Api) Run() {
 	log.Println("Starting server...")
-	if err := s.server.ListenAndServe(); err != nil {
+	if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalln("Unable to start HTTP server: ", err)
 	}
 }
 
 func (s *Api) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if s.shuttingDown {
+	if s.shuttingDown() {
 		http.Error(w, "Shutting Down", 503)
+		return
 	}
 
 	// Add headers, etc.
 	s.mux.ServeHTTP(w, r)
 }
 
+// Stops accepting requests and waits, up to ShutdownIngestTimeout, for
+// in-flight and queued ingest to finish. After that, whatever is still
+// queued is dropped, so nothing is published once the store is closed.
 func (s *Api) Close() error {
-	s.shuttingDown = true
-	s.Wait()
+	s.m.Lock()
+	if !s.shuttingDown() {
+		close(s.closing)
+	}
+	s.m.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.queue.Close()
+		return nil
+	case <-time.After(ShutdownIngestTimeout):
+		log.Printf("at=close in=api err=%q", ErrIngestTimeout)
+		s.queue.Stop()
+		return ErrIngestTimeout
+	}
+}
+
+// Closes the listener and waits, up to ShutdownStreamTimeout, for open
+// connections to finish. Streaming sessions should already have been ended
+// by closing the store.
+func (s *Api) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownStreamTimeout)
+	defer cancel()
+
+	if err := s.server.Shutdown(ctx); err != nil {
+		log.Printf("at=stop in=api err=%q", err)
+		return s.server.Close()
+	}
 	return nil
 }
 
+// Counts an ingest request in, so Close waits for it, unless the api is
+// already closing.
+func (s *Api) beginIngest() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.shuttingDown() {
+		return false
+	}
+	s.Add(1)
+	return true
+}
+
+func (s *Api) shuttingDown() bool {
+	select {
+	case <-s.closing:
+		return true
+	default:
+		return false
+	}
+}
+
 func (s *Api) healthCheck(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
 func (s *Api) logs(w http.ResponseWriter, r *http.Request) {
-	s.Add(1)
-	defer s.Done()
 	defer r.Body.Close()
+	if !s.beginIngest() {
+		http.Error(w, "Shutting Down", 503)
+		return
+	}
+	defer s.Done()
 
 	if drainId := r.Header.Get("Logplex-Drain-Token"); drainId != "" {
-		lp := lpx.NewReader(bufio.NewReader(r.Body))
-		for lp.Next() {
-			log.Printf("action=publish drainId=%s message=%s", drainId, string(lp.Bytes()))
-			s.store.Publish(drainId, lpToMessage(lp))
+		if owner, remote := s.remoteOwner(r, drainId); remote {
+			s.relayLogs(w, r, owner, drainId)
+			return
+		}
+
+		if !validContentType(r.Header.Get("Content-Type")) {
+			s.store.rejectBatch(ErrInvalidContentType)
+			http.Error(w, ErrInvalidContentType.Error(), http.StatusUnsupportedMediaType)
+			return
 		}
+
+		frameId := r.Header.Get("Logplex-Frame-Id")
+		msgs, err := readFrames(r.Body, r.Header.Get("Logplex-Msg-Count"))
+		if err != nil {
+			log.Printf("action=ingest drainId=%s frameId=%s err=%q", drainId, frameId, err)
+			s.store.rejectBatch(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Logplex retries batches it timed out on, which may have arrived.
+		if frameId != "" && s.store.frames.Seen(drainId, frameId) {
+			log.Printf("action=duplicate drainId=%s frameId=%s", drainId, frameId)
+			s.store.duplicateBatch()
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		// Published once the handler returns; Close waits for it.
+		s.Add(1)
+		if err := s.queue.Enqueue(ingestBatch{drainId, frameId, msgs}); err != nil {
+			s.Done()
+			log.Printf("action=ingest drainId=%s frameId=%s err=%q", drainId, frameId, err)
+			if frameId != "" {
+				s.store.frames.Forget(drainId, frameId)
+			}
+			if err == ErrIngestClosed {
+				http.Error(w, "Shutting Down", 503)
+				return
+			}
+			s.store.rejectBatch(err)
+			w.Header().Set("Retry-After", strconv.Itoa(IngestRetryAfter))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		s.store.acceptBatch(len(msgs))
 		w.WriteHeader(http.StatusAccepted)
 	} else {
 		w.WriteHeader(http.StatusUnauthorized)
 	}
 }
 
+// Publishes an ingested batch, from the queue's workers.
+func (s *Api) publishBatch(b ingestBatch) {
+	defer s.Done()
+
+	for i, msg := range b.msgs {
+		if s.queue.Stopped() {
+			s.store.failedMessages(len(b.msgs) - i)
+			return
+		}
+		msg = s.store.Redact(b.drainId, msg)
+		body, _ := fieldString(msg, "message")
+		log.Printf("action=publish drainId=%s message=%s", b.drainId, body)
+		if err := s.store.Publish(b.drainId, msg); err != nil {
+			log.Printf("action=publish drainId=%s frameId=%s err=%q", b.drainId, b.frameId, err)
+			s.store.failedMessages(len(b.msgs) - i)
+			return
+		}
+	}
+}
+
+// Returns a bounded set of buffered messages for a drain without holding
+// a stream open. The cursor to the next page, if any, is returned in the
+// Logflect-Next-Cursor header.
+func (s *Api) searchLogs(w http.ResponseWriter, r *http.Request) {
+	drainId := r.URL.Query().Get(":drain_id")
+	if owner, remote := s.remoteOwner(r, drainId); remote {
+		http.Redirect(w, r, owner+requestURI(r), http.StatusTemporaryRedirect)
+		return
+	}
+
+	sr, err := readSearchRequest(r.URL.Query(), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	msgs, next := s.store.Search(drainId, sr)
+	log.Printf("action=search drainId=%s count=%d", drainId, len(msgs))
+
+	if next > 0 {
+		w.Header().Set("Logflect-Next-Cursor", strconv.FormatUint(next, 10))
+	}
+
+	w.Header().Set("Content-Type", sr.format.ContentType())
+	for _, msg := range msgs {
+		sr.format.Message(w, msg)
+	}
+}
+
+// Streams rolling counts and rates of a drain's messages, optionally
+// grouped by a field.
+func (s *Api) aggregateLogs(w http.ResponseWriter, r *http.Request) {
+	drainId := r.URL.Query().Get(":drain_id")
+	if owner, remote := s.remoteOwner(r, drainId); remote {
+		http.Redirect(w, r, owner+requestURI(r), http.StatusTemporaryRedirect)
+		return
+	}
+
+	ar, err := readAggregateRequest(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	agg, err := s.store.Aggregate(drainId, ar)
+	if err == ErrShuttingDown {
+		http.Error(w, "Shutting Down", 503)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer s.store.DestroySession(agg.session.Id)
+
+	log.Printf("action=aggregate drainId=%s by=%s every=%s over=%s", drainId, ar.by, ar.every, ar.over)
+	agg.ServeHTTP(w, r)
+}
+
+// Returns the metrics extracted from a drain's `sample#`, `count#` and
+// `measure#` values, and router timings.
+func (s *Api) drainMetrics(w http.ResponseWriter, r *http.Request) {
+	drainId := r.URL.Query().Get(":drain_id")
+	if owner, remote := s.remoteOwner(r, drainId); remote {
+		http.Redirect(w, r, owner+requestURI(r), http.StatusTemporaryRedirect)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"drain_id": drainId,
+		"series":   s.store.Metrics(drainId),
+	})
+}
+
+// Exposes the latest metric values of every drain on this node to
+// Prometheus.
+func (s *Api) prometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := s.store.WriteMetrics(w); err != nil {
+		log.Printf("action=metrics err=%q", err)
+	}
+	fmt.Fprintf(w, "# HELP logflect_ingest_queued Ingested batches waiting to be published.\n# TYPE logflect_ingest_queued gauge\nlogflect_ingest_queued %d\n", s.queue.Len())
+}
+
+// Reports whether the session exists on this node, which peers use to
+// locate sessions.
+func (s *Api) headSession(w http.ResponseWriter, r *http.Request) {
+	sessionId := r.URL.Query().Get(":session_id")
+	if _, exists := s.store.GetSession(sessionId); !exists {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
 // Serves a session via chunked encoding
 func (s *Api) serveSession(w http.ResponseWriter, r *http.Request) {
 	sessionId := r.URL.Query().Get(":session_id")
 
 	if session, exists := s.store.GetSession(sessionId); !exists {
-		http.NotFound(w, r)
+		s.sessionNotFound(w, r, sessionId)
 		return
 	} else {
 		log.Printf("action=serve session_id=%s", sessionId)
@@ -99,7 +363,7 @@ func (s *Api) serveSession(w http.ResponseWriter, r *http.Request) {
 func (s *Api) deleteSession(w http.ResponseWriter, r *http.Request) {
 	sessionId := r.URL.Query().Get(":session_id")
 	if _, exists := s.store.GetSession(sessionId); !exists {
-		http.NotFound(w, r)
+		s.sessionNotFound(w, r, sessionId)
 		return
 	} else {
 		if s.store.DestroySession(sessionId) {
@@ -115,25 +379,233 @@ func (s *Api) newSession(w http.ResponseWriter, r *http.Request) {
 	// Creates a session and returns a 301 on success.
 	// TODO: Actually create the the session and stick it in there.
 
-	drainId, filter, err := readSessionRequest(r.Body)
+	body, err := ioutil.ReadAll(r.Body)
 	r.Body.Close()
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	if session, err := s.store.CreateSession(drainId, filter); err == ErrShuttingDown {
+	config, err := readSessionRequest(bytes.NewReader(body))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	sub := config.sub
+
+	// Sessions live on the node owning their drains, which the client is
+	// redirected to with its request intact. Groups and patterns only
+	// match drains owned by the node the session ends up on.
+	if s.cluster != nil && len(sub.DrainIds) > 0 {
+		owner := s.cluster.Owner(sub.DrainIds[0])
+		for _, drainId := range sub.DrainIds[1:] {
+			if s.cluster.Owner(drainId) != owner {
+				http.Error(w, "Drains are owned by different nodes", http.StatusConflict)
+				return
+			}
+		}
+		if _, remote := s.remoteOwner(r, sub.DrainIds[0]); remote {
+			http.Redirect(w, r, owner+requestURI(r), http.StatusTemporaryRedirect)
+			return
+		}
+	}
+
+	if session, err := s.store.Subscribe(sub, config.filter); err == ErrShuttingDown {
 		http.Error(w, "Shutting Down", 503)
 	} else if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Printf("action=create_session, err=%s", err)
 		return
 	} else {
-		log.Printf("action=create_session, id=%s drainId=%s", session.Id, drainId)
+		config.configure(session)
+		if err := s.store.ShareSession(session, body); err != nil {
+			log.Printf("action=share_session id=%s err=%q", session.Id, err)
+		}
+		log.Printf("action=create_session, id=%s drainIds=%s groups=%s patterns=%s", session.Id,
+			strings.Join(sub.DrainIds, ","), strings.Join(sub.Groups, ","), strings.Join(sub.Patterns, ","))
+
+		// Forward and alert sessions push their messages rather than being
+		// read, so there's nothing to redirect to.
+		if config.forward != nil || config.alert != nil {
+			if config.forward != nil {
+				StartForwarder(session, config.forward)
+			}
+			if config.alert != nil {
+				StartAlerter(session, config.alert)
+			}
+			w.Header().Set("Location", fmt.Sprintf("/v1/sessions/%s", session.Id))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]string{"id": session.Id})
+			return
+		}
 		http.Redirect(w, r, fmt.Sprintf("/v1/sessions/%s", session.Id), 301)
 	}
 }
 
+func (s *Api) getGroup(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	if drainIds, exists := s.store.GetGroup(name); !exists {
+		http.NotFound(w, r)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(groupRequest{DrainIds: drainIds})
+	}
+}
+
+// Defines a drain group. Sessions subscribed to the group follow changes
+// to its members.
+func (s *Api) setGroup(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+
+	drainIds, err := readGroupRequest(r.Body)
+	r.Body.Close()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.store.SetGroup(name, drainIds)
+	if s.cluster != nil && r.Header.Get(RelayedHeader) == "" {
+		body, _ := json.Marshal(groupRequest{DrainIds: drainIds})
+		s.cluster.Broadcast("PUT", r.URL.Path, body)
+	}
+	log.Printf("action=set_group name=%s drainIds=%s", name, strings.Join(drainIds, ","))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Api) deleteGroup(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	if s.cluster != nil && r.Header.Get(RelayedHeader) == "" {
+		s.cluster.Broadcast("DELETE", r.URL.Path, nil)
+	}
+
+	if !s.store.DeleteGroup(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	log.Printf("action=delete_group name=%s", name)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Api) getRedactions(w http.ResponseWriter, r *http.Request) {
+	drainId := r.URL.Query().Get(":drain_id")
+	if redactor, exists := s.store.GetRedactor(drainId); !exists {
+		http.NotFound(w, r)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"patterns":   redactor.request.Patterns,
+			"mask_keys":  redactor.request.MaskKeys,
+			"detectors":  redactor.request.Detectors,
+			"redactions": redactor.Count(),
+		})
+	}
+}
+
+// Sets the redactions applied to a drain's messages before they're
+// published, so no session sees the hidden values. Kept in sync across
+// the cluster, and the broker's replicas, like drain groups.
+func (s *Api) setRedactions(w http.ResponseWriter, r *http.Request) {
+	drainId := r.URL.Query().Get(":drain_id")
+
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	redactor, err := readRedactRequest(bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.store.SetRedactor(drainId, redactor)
+	if s.cluster != nil && r.Header.Get(RelayedHeader) == "" {
+		s.cluster.Broadcast("PUT", r.URL.Path, body)
+	}
+	log.Printf("action=set_redactions drainId=%s", drainId)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Api) deleteRedactions(w http.ResponseWriter, r *http.Request) {
+	drainId := r.URL.Query().Get(":drain_id")
+	if s.cluster != nil && r.Header.Get(RelayedHeader) == "" {
+		s.cluster.Broadcast("DELETE", r.URL.Path, nil)
+	}
+
+	if !s.store.DeleteRedactor(drainId) {
+		http.NotFound(w, r)
+		return
+	}
+
+	log.Printf("action=delete_redactions drainId=%s", drainId)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Returns the node owning `drainId`, if that isn't this node and the
+// request hasn't already been relayed by a peer.
+func (s *Api) remoteOwner(r *http.Request, drainId string) (string, bool) {
+	if s.cluster == nil || r.Header.Get(RelayedHeader) != "" {
+		return "", false
+	}
+
+	owner := s.cluster.Owner(drainId)
+	return owner, !s.cluster.IsSelf(owner)
+}
+
+// Relays an ingest request to the drain's owner. Failures are reported
+// with a 503 so Logplex retries the batch.
+func (s *Api) relayLogs(w http.ResponseWriter, r *http.Request, owner, drainId string) {
+	resp, err := s.cluster.RelayLogs(owner, r)
+	if err != nil {
+		log.Printf("action=relay drainId=%s peer=%s err=%q", drainId, owner, err)
+		http.Error(w, "Unable to relay to owner", http.StatusServiceUnavailable)
+		return
+	}
+	defer resp.Body.Close()
+
+	// Logplex backs off by the owner's Retry-After, and logs its reason
+	for _, name := range []string{"Retry-After", "Content-Type"} {
+		if v := resp.Header.Get(name); v != "" {
+			w.Header().Set(name, v)
+		}
+	}
+	log.Printf("action=relay drainId=%s peer=%s status=%d", drainId, owner, resp.StatusCode)
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, io.LimitReader(resp.Body, MaxRelayErrorSize))
+}
+
+// Redirects to the peer holding the session, if any.
+func (s *Api) sessionNotFound(w http.ResponseWriter, r *http.Request, sessionId string) {
+	if s.cluster != nil && r.Header.Get(RelayedHeader) == "" {
+		if peer, found := s.cluster.LocateSession(sessionId); found {
+			http.Redirect(w, r, peer+requestURI(r), http.StatusTemporaryRedirect)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// Returns the request's path and query, without the parameters pat adds
+// for matched route segments.
+func requestURI(r *http.Request) string {
+	query := r.URL.Query()
+	for k := range query {
+		if strings.HasPrefix(k, ":") {
+			query.Del(k)
+		}
+	}
+
+	if len(query) == 0 {
+		return r.URL.Path
+	}
+	return r.URL.Path + "?" + query.Encode()
+}
+
 func lpToMessage(lp *lpx.Reader) Message {
 	hdr := lp.Header()
 	return SyslogMessage{
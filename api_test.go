@@ -0,0 +1,26 @@
+package logflect
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestApi_ServeHTTPShuttingDown(t *testing.T) {
+	api := NewApi(NewStore(time.Hour, time.Hour), &http.Server{})
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/v1/health", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 before close, found %d", w.Code)
+	}
+
+	api.Close()
+
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/v1/health", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 after close, found %d", w.Code)
+	}
+}
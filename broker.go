@@ -0,0 +1,117 @@
+package logflect
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+const (
+	EventMessage        = "message"
+	EventSessionCreate  = "session_create"
+	EventSessionDestroy = "session_destroy"
+	EventRedactSet      = "redact_set"
+	EventRedactDelete   = "redact_delete"
+	EventGroupSet       = "group_set"
+	EventGroupDelete    = "group_delete"
+)
+
+// Carries published messages, session changes, ingest redactions and drain
+// groups between the logflect processes sharing drains. Every event is delivered to every subscriber,
+// including the process which published it.
+type Broker interface {
+	Publish(ev *BrokerEvent) error
+	Subscribe(fn func(*BrokerEvent)) error
+	Close() error
+}
+
+// An event as carried by a Broker.
+type BrokerEvent struct {
+	Type      string          `json:"type"`
+	Origin    string          `json:"origin"` // id of the publishing Store
+	DrainId   string          `json:"drain_id,omitempty"`
+	Message   *SyslogMessage  `json:"message,omitempty"` // set by brokers which encode events
+	SessionId string          `json:"session_id,omitempty"`
+	Group     string          `json:"group,omitempty"`
+	Request   json.RawMessage `json:"request,omitempty"` // the session, redact or group request
+	msg       Message         // the message as published, for in-process delivery
+}
+
+func newMessageEvent(origin, drainId string, msg Message) *BrokerEvent {
+	return &BrokerEvent{Type: EventMessage, Origin: origin, DrainId: drainId, msg: msg}
+}
+
+// Returns the event's message, whether it was delivered in-process or
+// decoded.
+func (ev *BrokerEvent) Msg() Message {
+	if ev.msg == nil && ev.Message != nil {
+		return *ev.Message
+	}
+	return ev.msg
+}
+
+// Encodes the event as JSON, converting its message to a SyslogMessage.
+func (ev *BrokerEvent) encode() ([]byte, error) {
+	if ev.msg != nil && ev.Message == nil {
+		wire := *ev
+		wire.Message = brokerMessage(ev.msg)
+		return json.Marshal(&wire)
+	}
+	return json.Marshal(ev)
+}
+
+func decodeBrokerEvent(data []byte) (*BrokerEvent, error) {
+	ev := &BrokerEvent{}
+	if err := json.Unmarshal(data, ev); err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
+
+// Delivers events synchronously within the process. The default Broker.
+type localBroker struct {
+	fn func(*BrokerEvent)
+	m  *sync.RWMutex
+}
+
+func NewLocalBroker() Broker {
+	return &localBroker{m: new(sync.RWMutex)}
+}
+
+func (b *localBroker) Publish(ev *BrokerEvent) error {
+	b.m.RLock()
+	fn := b.fn
+	b.m.RUnlock()
+
+	if fn != nil {
+		fn(ev)
+	}
+	return nil
+}
+
+func (b *localBroker) Subscribe(fn func(*BrokerEvent)) error {
+	b.m.Lock()
+	b.fn = fn
+	b.m.Unlock()
+	return nil
+}
+
+func (b *localBroker) Close() error {
+	return nil
+}
+
+// Converts `m` to a form that survives being encoded by a Broker.
+func brokerMessage(m Message) *SyslogMessage {
+	switch msg := m.(type) {
+	case SyslogMessage:
+		return &msg
+	case SequencedMessage:
+		return brokerMessage(msg.Message)
+	case RepeatedMessage:
+		inner := *brokerMessage(msg.Message)
+		inner.Message = []byte(fmt.Sprintf("%s [repeated %d times]", inner.Message, msg.Repeats))
+		return &inner
+	default:
+		return &SyslogMessage{Message: []byte(m.String())}
+	}
+}
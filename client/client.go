@@ -0,0 +1,487 @@
+// Package client talks to a logflect server: it creates, streams and
+// deletes sessions, and publishes frames for testing drains.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for the Client's tunables, and for published messages.
+const (
+	DefaultInitialBackoff = 500 * time.Millisecond
+	DefaultMaxBackoff     = 30 * time.Second
+	DefaultMaxLineSize    = 1024 * 1024
+	DefaultStreamBacklog  = 100
+	DefaultPriority       = "<190>1"
+)
+
+var (
+	ErrSessionGone = errors.New("Session no longer exists")
+	ErrNoDrains    = errors.New("No drains given")
+)
+
+// Returned when the server is busy (429) or restarting (503), and the
+// request should be sent again after RetryAfter, if it said.
+type RetryError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RetryError) Error() string {
+	return e.Err.Error()
+}
+
+// A logflect server's API. New sets the tunables to their defaults.
+type Client struct {
+	URL        string // base URL of the server, e.g. http://localhost:9000
+	HTTPClient *http.Client
+	ErrorLog   *log.Logger // where interrupted streams are reported; nil for nowhere
+
+	InitialBackoff time.Duration // wait before reconnecting a stream, doubled while it keeps failing
+	MaxBackoff     time.Duration
+	MaxLineSize    int // longest line a stream accepts
+	StreamBacklog  int // messages buffered between the connection and the consumer
+}
+
+// Matches messages whose `field` satisfies `type` with `param`, as in
+// the server's session filters.
+type Filter struct {
+	Field string `json:"field"`
+	Type  string `json:"type"`
+	Param string `json:"param"`
+}
+
+// Describes the session to create.
+type SessionRequest struct {
+	DrainIds      []string `json:"drain_ids,omitempty"`
+	DrainGroups   []string `json:"drain_groups,omitempty"`
+	DrainPatterns []string `json:"drain_patterns,omitempty"`
+	Filters       []Filter `json:"filters,omitempty"`
+	Sample        string   `json:"sample,omitempty"`
+	SampleBy      string   `json:"sample_by,omitempty"`
+	MaxRate       float64  `json:"max_rate,omitempty"`
+}
+
+type Session struct {
+	Id      string
+	URL     string // where the session lives, which may be another node
+	request SessionRequest
+}
+
+// A line of a stream: a log message, or a gap or notice marker.
+type Message struct {
+	Type          string `json:"type,omitempty"` // "", "gap" or "notice"
+	Seq           uint64 `json:"seq,omitempty"`
+	DrainId       string `json:"drain_id,omitempty"`
+	PrivalVersion string `json:"privalversion,omitempty"`
+	Time          string `json:"time,omitempty"`
+	Hostname      string `json:"hostname,omitempty"`
+	Name          string `json:"name,omitempty"`
+	Procid        string `json:"procid,omitempty"`
+	Msgid         string `json:"msgid,omitempty"`
+	Message       string `json:"message,omitempty"`
+	Repeated      int    `json:"repeated,omitempty"` // duplicates collapsed into this message
+	From          uint64 `json:"from,omitempty"`     // first sequence number lost, for gaps
+	To            uint64 `json:"to,omitempty"`       // last sequence number lost, for gaps
+
+	// Every field as received, including any added by transforms.
+	Fields map[string]interface{} `json:"-"`
+}
+
+// A session's messages, delivered over a channel until the context is done
+// or the stream fails for good.
+type Stream struct {
+	C <-chan Message
+
+	err error
+	m   *sync.Mutex
+}
+
+func New(url string) *Client {
+	return &Client{
+		URL:            strings.TrimRight(url, "/"),
+		HTTPClient:     &http.Client{},
+		InitialBackoff: DefaultInitialBackoff,
+		MaxBackoff:     DefaultMaxBackoff,
+		MaxLineSize:    DefaultMaxLineSize,
+		StreamBacklog:  DefaultStreamBacklog,
+	}
+}
+
+func Contains(field, needle string) Filter {
+	return Filter{Field: field, Type: "contains", Param: needle}
+}
+
+func Regexp(field, pattern string) Filter {
+	return Filter{Field: field, Type: "regexp", Param: pattern}
+}
+
+// Creates a session, following redirects to the node owning its drains.
+func (c *Client) CreateSession(ctx context.Context, request SessionRequest) (*Session, error) {
+	if len(request.DrainIds) == 0 && len(request.DrainGroups) == 0 && len(request.DrainPatterns) == 0 {
+		return nil, ErrNoDrains
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", c.URL+"/v1/sessions", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.noFollow().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMovedPermanently {
+		return nil, responseError("creating session", resp)
+	}
+
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return nil, err
+	}
+	id := location.Path[strings.LastIndex(location.Path, "/")+1:]
+	return &Session{Id: id, URL: location.String(), request: request}, nil
+}
+
+func (c *Client) DeleteSession(ctx context.Context, s *Session) error {
+	req, err := http.NewRequest("DELETE", s.URL, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return responseError("deleting session", resp)
+	}
+	return nil
+}
+
+// Streams the session's messages. Dropped connections are retried with
+// backoff, resuming after the last message received from each drain, and
+// the session is recreated if it expired, updating `s`: wait for the
+// stream's channel to close before using `s` again.
+func (c *Client) Stream(ctx context.Context, s *Session) *Stream {
+	ch := make(chan Message, c.StreamBacklog)
+	stream := &Stream{C: ch, m: new(sync.Mutex)}
+
+	go func() {
+		defer close(ch)
+		stream.setErr(c.stream(ctx, s, ch))
+	}()
+	return stream
+}
+
+// Returns why the stream ended, once its channel is closed. Nil if the
+// context was done.
+func (s *Stream) Err() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.err
+}
+
+func (s *Stream) setErr(err error) {
+	s.m.Lock()
+	s.err = err
+	s.m.Unlock()
+}
+
+func (c *Client) stream(ctx context.Context, s *Session, ch chan<- Message) error {
+	after := make(map[string]uint64)
+	backoff := c.InitialBackoff
+
+	for ctx.Err() == nil {
+		received, err := c.streamOnce(ctx, s, after, ch)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if err == ErrSessionGone {
+			c.logf("Session %s is gone, creating another", s.Id)
+			renewed, err := c.CreateSession(ctx, s.request)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			*s = *renewed
+			continue
+		}
+		if received {
+			backoff = c.InitialBackoff
+		}
+		c.logf("Stream of session %s interrupted (%s), reconnecting in %s", s.Id, err, backoff)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > c.MaxBackoff {
+			backoff = c.MaxBackoff
+		}
+	}
+	return nil
+}
+
+// Streams over a single connection, until it ends. Reports whether
+// anything arrived.
+func (c *Client) streamOnce(ctx context.Context, s *Session, after map[string]uint64, ch chan<- Message) (bool, error) {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return false, err
+	}
+	query := u.Query()
+	query.Set("format", "ndjson")
+	if v := resumeFrom(after); v != "" {
+		query.Set("after", v)
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, ErrSessionGone
+	case resp.StatusCode != http.StatusOK:
+		return false, responseError("streaming session", resp)
+	}
+
+	// Drains which stay quiet resume from where they stood as the stream
+	// started, so nothing they publish while reconnecting is lost.
+	for drainId, seq := range parsePosition(resp.Header.Get("Logflect-Position")) {
+		if _, exists := after[drainId]; !exists {
+			after[drainId] = seq
+		}
+	}
+
+	received := false
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), c.MaxLineSize)
+	for scanner.Scan() {
+		msg, ok, err := parseLine(scanner.Bytes())
+		if err != nil {
+			return received, err
+		}
+		if !ok {
+			continue
+		}
+		received = true
+
+		if msg.Type == "" && msg.Seq > 0 {
+			after[msg.DrainId] = msg.Seq
+		}
+		select {
+		case ch <- msg:
+		case <-ctx.Done():
+			return received, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return received, err
+	}
+	return received, io.ErrUnexpectedEOF
+}
+
+// Parses a line of an ndjson stream. Heartbeats and blank lines aren't
+// messages.
+func parseLine(line []byte) (Message, bool, error) {
+	var msg Message
+	if len(bytes.TrimSpace(line)) == 0 {
+		return msg, false, nil
+	}
+
+	// transforms may give standard fields other types, which stay in Fields
+	if err := json.Unmarshal(line, &msg); err != nil {
+		if _, ok := err.(*json.UnmarshalTypeError); !ok {
+			return msg, false, err
+		}
+	}
+	if msg.Type == "heartbeat" {
+		return msg, false, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	if err := decoder.Decode(&msg.Fields); err != nil {
+		return msg, false, err
+	}
+	return msg, true, nil
+}
+
+// Parses the Logflect-Position header: `drain:seq` pairs separated by
+// commas. Malformed pairs are skipped.
+func parsePosition(v string) map[string]uint64 {
+	position := make(map[string]uint64)
+	for _, pair := range strings.Split(v, ",") {
+		i := strings.LastIndex(pair, ":")
+		if i <= 0 {
+			continue
+		}
+		if seq, err := strconv.ParseUint(pair[i+1:], 10, 64); err == nil {
+			position[pair[:i]] = seq
+		}
+	}
+	return position
+}
+
+// Returns the `after` parameter resuming every drain seen so far.
+func resumeFrom(after map[string]uint64) string {
+	pairs := make([]string, 0, len(after))
+	for drainId, seq := range after {
+		if drainId == "" {
+			return strconv.FormatUint(seq, 10)
+		}
+		pairs = append(pairs, drainId+":"+strconv.FormatUint(seq, 10))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Publishes messages to a drain as a Logplex frame, as if from a drain.
+// Empty fields are filled in: the priority with DefaultPriority, the time
+// with now, and the rest with "-".
+func (c *Client) Publish(ctx context.Context, drainId string, msgs ...Message) error {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	lines := make([][]byte, len(msgs))
+	for i, m := range msgs {
+		lines[i] = []byte(strings.Join([]string{
+			orDefault(m.PrivalVersion, DefaultPriority),
+			orDefault(m.Time, now),
+			orDefault(m.Hostname, "-"),
+			orDefault(m.Name, "-"),
+			orDefault(m.Procid, "-"),
+			orDefault(m.Msgid, "-"),
+			m.Message,
+		}, " "))
+	}
+	return c.PublishLines(ctx, drainId, NewFrameId(), lines...)
+}
+
+// Publishes syslog lines to a drain as a single Logplex frame, octet
+// counting each line. Retries of a batch should send the same `frameId`,
+// so the server skips it if it did arrive.
+func (c *Client) PublishLines(ctx context.Context, drainId, frameId string, lines ...[]byte) error {
+	var body bytes.Buffer
+	for _, line := range lines {
+		fmt.Fprintf(&body, "%d ", len(line))
+		body.Write(line)
+	}
+
+	req, err := http.NewRequest("POST", c.URL+"/v1/logs", &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/logplex-1")
+	req.Header.Set("Logplex-Drain-Token", drainId)
+	req.Header.Set("Logplex-Msg-Count", strconv.Itoa(len(lines)))
+	req.Header.Set("Logplex-Frame-Id", frameId)
+
+	resp, err := c.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+		return &RetryError{Err: responseError("publishing", resp), RetryAfter: retryAfter(resp)}
+	case resp.StatusCode/100 != 2:
+		return responseError("publishing", resp)
+	}
+	return nil
+}
+
+// Returns a copy of the HTTP client which follows redirects to other
+// nodes, but not to a new session.
+func (c *Client) noFollow() *http.Client {
+	hc := *c.HTTPClient
+	hc.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if req.Response != nil && req.Response.StatusCode == http.StatusMovedPermanently {
+			return http.ErrUseLastResponse
+		}
+		if len(via) >= 10 {
+			return errors.New("Too many redirects")
+		}
+		return nil
+	}
+	return &hc
+}
+
+func (c *Client) logf(format string, args ...interface{}) {
+	if c.ErrorLog != nil {
+		c.ErrorLog.Printf(format, args...)
+	}
+}
+
+func responseError(action string, resp *http.Response) error {
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if msg = bytes.TrimSpace(msg); len(msg) > 0 {
+		return fmt.Errorf("%s: %s (%s)", action, resp.Status, msg)
+	}
+	return fmt.Errorf("%s: %s", action, resp.Status)
+}
+
+// Returns how long a response asks to wait before retrying, or zero.
+func retryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// Returns a random id for a batch of lines.
+func NewFrameId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func orDefault(v, fallback string) string {
+	if v == "" {
+		return fallback
+	}
+	return v
+}
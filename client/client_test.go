@@ -0,0 +1,232 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apg/logflect"
+)
+
+func newTestServer() *httptest.Server {
+	store := logflect.NewStore(time.Hour, time.Hour)
+	return httptest.NewServer(logflect.NewApi(store, &http.Server{}))
+}
+
+func receive(t *testing.T, stream *Stream) Message {
+	select {
+	case msg, open := <-stream.C:
+		if !open {
+			t.Fatalf("stream ended (%v)", stream.Err())
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a message")
+	}
+	return Message{}
+}
+
+func TestClient_StreamAndPublish(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := New(server.URL)
+	session, err := c.CreateSession(ctx, SessionRequest{
+		DrainIds: []string{"d.web"},
+		Filters:  []Filter{Contains("message", "up")},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	if session.Id == "" || session.URL != server.URL+"/v1/sessions/"+session.Id {
+		t.Errorf("unexpected session %+v", session)
+	}
+
+	stream := c.Stream(ctx, session)
+	time.Sleep(100 * time.Millisecond) // let the stream attach
+
+	err = c.Publish(ctx, "d.web",
+		Message{Name: "app", Procid: "web.1", Message: "starting"},
+		Message{Name: "app", Procid: "web.1", Message: "State changed from starting to up"},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	msg := receive(t, stream)
+	if msg.Name != "app" || msg.Procid != "web.1" || msg.Message != "State changed from starting to up" || msg.Seq != 2 {
+		t.Errorf("unexpected message %+v", msg)
+	}
+	if msg.Fields["hostname"] != "-" {
+		t.Errorf("expected every field in Fields, found %v", msg.Fields)
+	}
+
+	cancel()
+	for range stream.C {
+	}
+	if err := stream.Err(); err != nil {
+		t.Errorf("expected no error after cancelling, found %s", err)
+	}
+
+	if err := c.DeleteSession(context.Background(), session); err != nil {
+		t.Errorf("unexpected error deleting (%s)", err)
+	}
+}
+
+func TestClient_StreamRecreatesSession(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := New(server.URL)
+	session, err := c.CreateSession(ctx, SessionRequest{DrainIds: []string{"d.web"}})
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	original := *session
+
+	// the session disappears before it's streamed
+	if err := c.DeleteSession(ctx, &original); err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	stream := c.Stream(ctx, session)
+	time.Sleep(200 * time.Millisecond)
+	if err := c.Publish(ctx, "d.web", Message{Message: "hello"}); err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	if msg := receive(t, stream); msg.Message != "hello" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+
+	cancel()
+	for range stream.C {
+	}
+	if session.Id == original.Id {
+		t.Errorf("expected a new session")
+	}
+}
+
+func TestClient_StreamResumesSilentDrains(t *testing.T) {
+	store := logflect.NewStore(time.Hour, time.Hour)
+	api := logflect.NewApi(store, &http.Server{})
+
+	// holds reconnections back until released
+	var m sync.Mutex
+	streams := 0
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/v1/sessions/") {
+			m.Lock()
+			streams++
+			reconnect := streams > 1
+			m.Unlock()
+			if reconnect {
+				<-release
+			}
+		}
+		api.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// publishes over connections of its own, which aren't dropped
+	publisher := New(server.URL)
+	publisher.HTTPClient = &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	// buffered before the session exists, so never streamed
+	for i := 0; i < 3; i++ {
+		if err := publisher.Publish(ctx, "d.b", Message{Message: "old"}); err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+	}
+
+	c := New(server.URL)
+	session, err := c.CreateSession(ctx, SessionRequest{DrainIds: []string{"d.a", "d.b"}})
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	stream := c.Stream(ctx, session)
+	time.Sleep(100 * time.Millisecond)
+	if err := publisher.Publish(ctx, "d.a", Message{Message: "one"}); err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	if msg := receive(t, stream); msg.Message != "one" {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+
+	// d.b hasn't said anything before the connection drops
+	server.CloseClientConnections()
+	for _, drainId := range []string{"d.b", "d.a"} {
+		if err := publisher.Publish(ctx, drainId, Message{Message: "from " + drainId}); err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+	}
+	close(release)
+
+	received := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		received[receive(t, stream).Message] = true
+	}
+	if !received["from d.a"] || !received["from d.b"] {
+		t.Errorf("expected both drains resumed, found %v", received)
+	}
+	select {
+	case msg := <-stream.C:
+		t.Errorf("expected nothing else replayed, found %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel()
+	for range stream.C {
+	}
+}
+
+func TestCreateSession_NoDrains(t *testing.T) {
+	if _, err := New("http://localhost:1").CreateSession(context.Background(), SessionRequest{}); err != ErrNoDrains {
+		t.Errorf("expected ErrNoDrains, got %v", err)
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	if _, ok, err := parseLine([]byte(`{"type":"heartbeat"}`)); ok || err != nil {
+		t.Errorf("expected heartbeats to be skipped")
+	}
+
+	msg, ok, err := parseLine([]byte(`{"type":"gap","drain_id":"d.web","from":3,"to":9}`))
+	if !ok || err != nil || msg.Type != "gap" || msg.From != 3 || msg.To != 9 {
+		t.Errorf("unexpected gap %+v (%v)", msg, err)
+	}
+
+	// transformed fields keep their types in Fields
+	msg, ok, err = parseLine([]byte(`{"seq":4,"drain_id":"d.web","name":"router","time":18}`))
+	if !ok || err != nil || msg.Seq != 4 || msg.Name != "router" || msg.Fields["time"] == nil {
+		t.Errorf("unexpected message %+v (%v)", msg, err)
+	}
+}
+
+func TestParsePosition(t *testing.T) {
+	position := parsePosition("d.a:7,app:web:3,bogus,d.c:x")
+	if len(position) != 2 || position["d.a"] != 7 || position["app:web"] != 3 {
+		t.Errorf("unexpected position %v", position)
+	}
+}
+
+func TestResumeFrom(t *testing.T) {
+	if v := resumeFrom(map[string]uint64{"d.b": 2, "d.a": 7}); v != "d.a:7,d.b:2" {
+		t.Errorf("unexpected resume position %q", v)
+	}
+}
@@ -0,0 +1,190 @@
+package logflect
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Set on requests relayed between nodes, so they're handled locally
+	// instead of being relayed again.
+	RelayedHeader = "Logflect-Relayed-By"
+
+	ClusterRingReplicas = 64
+	ClusterPeerTimeout  = 2 * time.Second
+)
+
+var (
+	ErrInvalidPeer    = errors.New("Invalid peer URL")
+	ErrSelfNotInPeers = errors.New("Self is not in the peer list")
+)
+
+// A static set of logflect nodes sharing drains. Each drain is owned by the
+// node its id hashes to: ingest for the drain is relayed there, and its
+// sessions are created there.
+type Cluster struct {
+	self   string
+	peers  []string
+	ring   *hashRing
+	client *http.Client
+}
+
+// Consistent hash ring with virtual nodes, mapping drain ids to peers.
+type hashRing struct {
+	hashes []uint32
+	owners map[uint32]string
+}
+
+// Creates a cluster from peer base URLs (e.g. `http://10.0.0.1:9000`).
+// `self` must be one of `peers`.
+func NewCluster(self string, peers []string) (*Cluster, error) {
+	self = strings.TrimRight(self, "/")
+	normalized := make([]string, 0, len(peers))
+	found := false
+
+	for _, peer := range peers {
+		peer = strings.TrimRight(peer, "/")
+		if u, err := url.Parse(peer); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, ErrInvalidPeer
+		}
+		if peer == self {
+			found = true
+		}
+		normalized = append(normalized, peer)
+	}
+
+	if !found {
+		return nil, ErrSelfNotInPeers
+	}
+
+	return &Cluster{
+		self:   self,
+		peers:  normalized,
+		ring:   newHashRing(normalized, ClusterRingReplicas),
+		client: &http.Client{Timeout: ClusterPeerTimeout},
+	}, nil
+}
+
+// Returns the base URL of the node owning `drainId`.
+func (c *Cluster) Owner(drainId string) string {
+	return c.ring.owner(drainId)
+}
+
+func (c *Cluster) IsSelf(peer string) bool {
+	return peer == c.self
+}
+
+// Relays an ingest request to `peer`, returning the peer's response. The
+// caller closes its body.
+func (c *Cluster) RelayLogs(peer string, r *http.Request) (*http.Response, error) {
+	req, err := http.NewRequest("POST", peer+"/v1/logs", r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range r.Header {
+		if strings.HasPrefix(name, "Logplex-") || name == "Content-Type" {
+			req.Header[name] = values
+		}
+	}
+
+	return c.do(req)
+}
+
+// Asks every other node whether it holds `sessionId`, returning the base
+// URL of the first that does.
+func (c *Cluster) LocateSession(sessionId string) (string, bool) {
+	for _, peer := range c.peers {
+		if c.IsSelf(peer) {
+			continue
+		}
+
+		req, err := http.NewRequest("HEAD", fmt.Sprintf("%s/v1/sessions/%s", peer, sessionId), nil)
+		if err != nil {
+			continue
+		}
+
+		resp, err := c.do(req)
+		if err != nil {
+			log.Printf("action=locate_session peer=%s err=%q", peer, err)
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusOK {
+			return peer, true
+		}
+	}
+
+	return "", false
+}
+
+// Sends a request to every other node, e.g. to keep drain groups in sync.
+// Failures are logged, not returned.
+func (c *Cluster) Broadcast(method, path string, body []byte) {
+	for _, peer := range c.peers {
+		if c.IsSelf(peer) {
+			continue
+		}
+
+		req, err := http.NewRequest(method, peer+path, bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+
+		if resp, err := c.do(req); err != nil {
+			log.Printf("action=broadcast peer=%s path=%s err=%q", peer, path, err)
+		} else {
+			resp.Body.Close()
+		}
+	}
+}
+
+func (c *Cluster) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set(RelayedHeader, c.self)
+	return c.client.Do(req)
+}
+
+func newHashRing(peers []string, replicas int) *hashRing {
+	ring := &hashRing{
+		hashes: make([]uint32, 0, len(peers)*replicas),
+		owners: make(map[uint32]string),
+	}
+
+	for _, peer := range peers {
+		for i := 0; i < replicas; i++ {
+			h := hashKey(fmt.Sprintf("%s#%d", peer, i))
+			if _, exists := ring.owners[h]; exists {
+				continue
+			}
+			ring.owners[h] = peer
+			ring.hashes = append(ring.hashes, h)
+		}
+	}
+
+	sort.Slice(ring.hashes, func(i, j int) bool { return ring.hashes[i] < ring.hashes[j] })
+	return ring
+}
+
+func (r *hashRing) owner(key string) string {
+	h := hashKey(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
@@ -0,0 +1,159 @@
+package logflect
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewCluster_Invalid(t *testing.T) {
+	if _, err := NewCluster("http://a:9000", []string{"http://b:9000"}); err != ErrSelfNotInPeers {
+		t.Errorf("expected ErrSelfNotInPeers, found %v", err)
+	}
+	if _, err := NewCluster("a:9000", []string{"a:9000"}); err != ErrInvalidPeer {
+		t.Errorf("expected ErrInvalidPeer, found %v", err)
+	}
+}
+
+func TestHashRing_Owner(t *testing.T) {
+	peers := []string{"http://a:9000", "http://b:9000", "http://c:9000"}
+	ring := newHashRing(peers, ClusterRingReplicas)
+
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		drainId := fmt.Sprintf("d.%d", i)
+		owner := ring.owner(drainId)
+		if owner != ring.owner(drainId) {
+			t.Fatalf("owner of %s isn't stable", drainId)
+		}
+		counts[owner]++
+	}
+
+	for _, peer := range peers {
+		if counts[peer] < 500 {
+			t.Errorf("%s owns only %d of 3000 drains", peer, counts[peer])
+		}
+	}
+
+	// removing a node only moves the drains it owned
+	smaller := newHashRing(peers[:2], ClusterRingReplicas)
+	for i := 0; i < 3000; i++ {
+		drainId := fmt.Sprintf("d.%d", i)
+		if owner := ring.owner(drainId); owner != peers[2] && smaller.owner(drainId) != owner {
+			t.Errorf("%s moved from %s after removing %s", drainId, owner, peers[2])
+		}
+	}
+}
+
+// Starts two clustered nodes, returning their stores and servers.
+func startCluster(t *testing.T) ([]*Store, []*httptest.Server) {
+	stores := []*Store{NewStore(time.Hour, time.Hour), NewStore(time.Hour, time.Hour)}
+	apis := []*Api{NewApi(stores[0], &http.Server{}), NewApi(stores[1], &http.Server{})}
+	servers := []*httptest.Server{httptest.NewServer(apis[0]), httptest.NewServer(apis[1])}
+	peers := []string{servers[0].URL, servers[1].URL}
+
+	for i, api := range apis {
+		cluster, err := NewCluster(peers[i], peers)
+		if err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		api.SetCluster(cluster)
+	}
+	return stores, servers
+}
+
+func TestCluster_RelayAndRedirect(t *testing.T) {
+	stores, servers := startCluster(t)
+	defer servers[0].Close()
+	defer servers[1].Close()
+
+	// a drain owned by the second node
+	ring := newHashRing([]string{servers[0].URL, servers[1].URL}, ClusterRingReplicas)
+	drainId := "d.0"
+	for i := 1; ring.owner(drainId) != servers[1].URL; i++ {
+		drainId = fmt.Sprintf("d.%d", i)
+	}
+
+	session, _ := stores[1].CreateSession(drainId, NoFilter{})
+
+	frame := "<174>1 2012-07-22T00:06:26-00:00 somehost app web.1 - Hi"
+	req, _ := http.NewRequest("POST", servers[0].URL+"/v1/logs", strings.NewReader(fmt.Sprintf("%d %s", len(frame), frame)))
+	req.Header.Set("Logplex-Drain-Token", drainId)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("expected relayed 202, found %d", resp.StatusCode)
+	}
+	if _, exists := stores[0].lookupFeed(drainId); exists {
+		t.Errorf("message published on the node not owning the drain")
+	}
+	// ingest is published asynchronously
+	var msgs []Message
+	for deadline := time.Now().Add(time.Second); len(msgs) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		msgs, _, _ = stores[1].getFeed(drainId).Since(0)
+	}
+	if len(msgs) != 1 {
+		t.Errorf("expected 1 message on the owning node, found %d", len(msgs))
+	}
+
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err = noFollow.Get(servers[0].URL + "/v1/sessions/" + session.Id + "?format=ndjson")
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	resp.Body.Close()
+
+	expected := servers[1].URL + "/v1/sessions/" + session.Id + "?format=ndjson"
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != expected {
+		t.Errorf("expected redirect to %s, found %d %s", expected, resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
+
+func TestCluster_RelayRetryAfter(t *testing.T) {
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, ErrIngestQueueFull.Error(), http.StatusTooManyRequests)
+	}))
+	defer owner.Close()
+
+	api := NewApi(NewStore(time.Hour, time.Hour), &http.Server{})
+	node := httptest.NewServer(api)
+	defer node.Close()
+
+	peers := []string{node.URL, owner.URL}
+	cluster, err := NewCluster(node.URL, peers)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	api.SetCluster(cluster)
+
+	ring := newHashRing(peers, ClusterRingReplicas)
+	drainId := "d.0"
+	for i := 1; ring.owner(drainId) != owner.URL; i++ {
+		drainId = fmt.Sprintf("d.%d", i)
+	}
+
+	req, _ := http.NewRequest("POST", node.URL+"/v1/logs", strings.NewReader(testBatch(1)))
+	req.Header.Set("Logplex-Drain-Token", drainId)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("expected the owner's 429 and Retry-After, found %d %v", resp.StatusCode, resp.Header)
+	}
+	if strings.TrimSpace(string(body)) != ErrIngestQueueFull.Error() {
+		t.Errorf("expected the owner's error, found %q", body)
+	}
+}
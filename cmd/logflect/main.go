@@ -1,18 +1,32 @@
 package main
 
 import (
+	"flag"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/apg/logflect"
 )
 
+var (
+	addr  = flag.String("addr", ":9000", "address to listen on")
+	self  = flag.String("self", "", "this node's base URL, when running as part of a cluster")
+	peers = flag.String("peers", "", "comma separated base URLs of every cluster node, including this one")
+
+	redisUrl     = flag.String("redis-url", "", "redis://[:password@]host:port to share drains and sessions between replicas over")
+	redisChannel = flag.String("redis-channel", logflect.DefaultRedisChannel, "redis pub/sub channel")
+
+	frameIds   = flag.Int("frame-ids", logflect.DefaultFrameIdsPerDrain, "Logplex frame ids remembered per drain, to skip retried batches")
+	frameIdTTL = flag.Duration("frame-id-ttl", logflect.DefaultFrameIdTTL, "how long Logplex frame ids are remembered")
+)
+
 func awaitSignals(cs ...io.Closer) {
-	sigCh := make(chan os.Signal)
+	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
 	sig := <-sigCh
 	log.Printf("Got signal: %q", sig)
@@ -22,12 +36,45 @@ func awaitSignals(cs ...io.Closer) {
 }
 
 func main() {
-	httpServer := &http.Server{Addr: ":9000"}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "tail":
+			runTail(os.Args[2:])
+			return
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		}
+	}
+
+	flag.Parse()
+
+	httpServer := &http.Server{Addr: *addr}
 	shutdownChan := make(chan struct{})
 	store := logflect.NewStore(logflect.MaxFeedAge, logflect.MaxSessionAge)
+	store.SetFrameIds(*frameIds, *frameIdTTL)
+
+	if *redisUrl != "" {
+		broker, err := logflect.NewRedisBroker(*redisUrl, *redisChannel)
+		if err != nil {
+			log.Fatalln("Unable to configure redis: ", err)
+		}
+		if err := store.SetBroker(broker); err != nil {
+			log.Fatalln("Unable to subscribe to redis: ", err)
+		}
+	}
+
 	server := logflect.NewServer(httpServer, store, shutdownChan)
 
+	if *peers != "" {
+		cluster, err := logflect.NewCluster(*self, strings.Split(*peers, ","))
+		if err != nil {
+			log.Fatalln("Unable to configure cluster: ", err)
+		}
+		server.SetCluster(cluster)
+	}
+
 	go awaitSignals(server)
-	go server.Shutdown()
-	server.Run()
+	go server.Run()
+	server.Shutdown()
 }
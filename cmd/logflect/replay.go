@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/apg/logflect/client"
+)
+
+const (
+	defaultReplayBatch = 100 // lines per POST, as Logplex sends them
+	maxReplayLine      = 64 * 1024
+	maxReplayRetries   = 10          // attempts at a batch the server is too busy for
+	replayRetryAfter   = time.Second // wait between them, unless the server says
+)
+
+var errInvalidFrame = errors.New("invalid frame")
+
+// Replays files of syslog lines to a drain: octet counted, as Logplex
+// frames them, or one per line.
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	server := fs.String("url", envOr("LOGFLECT_URL", "http://localhost:9000"), "logflect server base URL")
+	drainId := fs.String("drain", "", "drain token to publish as")
+	batch := fs.Int("batch", defaultReplayBatch, "maximum lines per request")
+	speed := fs.Float64("speed", 1, "pace relative to the lines' timestamps: 1 for real time, 10 for ten times faster, 0 for as fast as possible")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: logflect replay -drain d.123 [flags] [file...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *drainId == "" || *batch < 1 || *speed < 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-sigCh
+		cancel()
+	}()
+
+	r := &replayer{client: client.New(*server), drainId: *drainId, batch: *batch, speed: *speed}
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, name := range files {
+		if err := r.replayFile(ctx, name); err != nil && ctx.Err() == nil {
+			log.Fatalf("Unable to replay %s: %s", name, err)
+		}
+	}
+	log.Printf("Replayed %d lines in %d requests", r.lines, r.requests)
+}
+
+// Publishes lines in batches, paced by their timestamps.
+type replayer struct {
+	client  *client.Client
+	drainId string
+	batch   int
+	speed   float64 // zero for no pacing
+
+	pending  [][]byte
+	first    time.Time // timestamp of the first line, and when it was replayed
+	start    time.Time
+	lines    int
+	requests int
+}
+
+func (r *replayer) replayFile(ctx context.Context, name string) error {
+	in := io.Reader(os.Stdin)
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	frames := bufio.NewReader(in)
+	for ctx.Err() == nil {
+		line, err := readFrame(frames)
+		if err == io.EOF {
+			return r.flush(ctx)
+		}
+		if err != nil {
+			return err
+		}
+		if err := r.add(ctx, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Queues `line`, first sending what's queued if `line` isn't due yet.
+func (r *replayer) add(ctx context.Context, line []byte) error {
+	if due, ok := r.due(line); ok {
+		if wait := time.Until(due); wait > 0 {
+			if err := r.flush(ctx); err != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+	}
+
+	r.pending = append(r.pending, line)
+	if len(r.pending) >= r.batch {
+		return r.flush(ctx)
+	}
+	return nil
+}
+
+// Returns when `line` should be sent, if it's paced.
+func (r *replayer) due(line []byte) (time.Time, bool) {
+	if r.speed == 0 {
+		return time.Time{}, false
+	}
+	t, ok := lineTime(line)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	if r.first.IsZero() {
+		r.first, r.start = t, time.Now()
+	}
+	offset := float64(t.Sub(r.first)) / r.speed
+	return r.start.Add(time.Duration(offset)), true
+}
+
+// Sends what's queued, retrying while the server is busy or restarting.
+func (r *replayer) flush(ctx context.Context) error {
+	if len(r.pending) == 0 {
+		return nil
+	}
+
+	frameId := client.NewFrameId()
+	for attempt := 1; ; attempt++ {
+		err := r.client.PublishLines(ctx, r.drainId, frameId, r.pending...)
+		if err == nil {
+			break
+		}
+		retry, ok := err.(*client.RetryError)
+		if !ok || attempt == maxReplayRetries {
+			return err
+		}
+
+		wait := retry.RetryAfter
+		if wait == 0 {
+			wait = replayRetryAfter
+		}
+		log.Printf("Retrying in %s: %s", wait, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	r.lines += len(r.pending)
+	r.requests++
+	r.pending = nil
+	return nil
+}
+
+// Reads the next syslog line: octet counted, as in Logplex frames, or up
+// to the end of the line.
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	// skip separators between frames
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if c != '\n' && c != '\r' && c != ' ' && c != '\t' {
+			r.UnreadByte()
+			break
+		}
+	}
+
+	// octet counted frames start `N <PRI>`
+	head, err := r.Peek(8)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if i := bytes.IndexByte(head, ' '); i > 0 && i+1 < len(head) && head[i+1] == '<' {
+		if n, err := strconv.Atoi(string(head[:i])); err == nil {
+			if n <= 0 || n > maxReplayLine {
+				return nil, errInvalidFrame
+			}
+			r.Discard(i + 1)
+			line := make([]byte, n)
+			if _, err := io.ReadFull(r, line); err != nil {
+				return nil, errInvalidFrame
+			}
+			return line, nil
+		}
+	}
+
+	line, err := r.ReadBytes('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+// Returns the timestamp of a syslog line, `<PRI>VERSION TIMESTAMP ...`.
+func lineTime(line []byte) (time.Time, bool) {
+	fields := bytes.SplitN(line, []byte(" "), 3)
+	if len(fields) < 3 {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, string(fields[1]))
+	return t, err == nil
+}
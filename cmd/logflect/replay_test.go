@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apg/logflect/client"
+)
+
+func TestReadFrame(t *testing.T) {
+	in := "66 <174>1 2012-07-22T00:06:26-00:00 somehost Go console - Hi from bar\n" +
+		"<174>1 2012-07-22T00:06:27-00:00 somehost Go console - plain line\r\n" +
+		"12 <13>1 - - x\n" +
+		"12 apples fell\n"
+	r := bufio.NewReader(strings.NewReader(in))
+
+	expected := []string{
+		"<174>1 2012-07-22T00:06:26-00:00 somehost Go console - Hi from bar",
+		"<174>1 2012-07-22T00:06:27-00:00 somehost Go console - plain line",
+		"<13>1 - - x\n",
+		"12 apples fell",
+	}
+	for _, e := range expected {
+		line, err := readFrame(r)
+		if err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		if string(line) != e {
+			t.Errorf("expected %q, found %q", e, line)
+		}
+	}
+	if _, err := readFrame(r); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	if _, err := readFrame(bufio.NewReader(strings.NewReader("80 <13>1 short"))); err != errInvalidFrame {
+		t.Errorf("expected errInvalidFrame for a truncated frame, got %v", err)
+	}
+}
+
+func TestReplayer_FlushRetries(t *testing.T) {
+	var frameIds []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		frameIds = append(frameIds, r.Header.Get("Logplex-Frame-Id"))
+		if len(frameIds) == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Ingest queue full", http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	r := &replayer{client: client.New(ts.URL), drainId: "d.web", pending: [][]byte{[]byte("<13>1 - - x")}}
+	if err := r.flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	if len(frameIds) != 2 || frameIds[0] == "" || frameIds[0] != frameIds[1] {
+		t.Errorf("expected one retry with the same frame id, found %v", frameIds)
+	}
+	if r.lines != 1 || r.requests != 1 {
+		t.Errorf("expected the batch counted once, found %d lines in %d requests", r.lines, r.requests)
+	}
+}
+
+func TestReplayer_Due(t *testing.T) {
+	r := &replayer{speed: 10}
+	first, ok := r.due([]byte("<174>1 2012-07-22T00:06:26-00:00 host app - hi"))
+	if !ok {
+		t.Fatalf("expected the line to be paced")
+	}
+	later, _ := r.due([]byte("<174>1 2012-07-22T00:06:36-00:00 host app - hi"))
+	if d := later.Sub(first); d != time.Second {
+		t.Errorf("expected 10s at 10x to take 1s, found %s", d)
+	}
+
+	if _, ok := r.due([]byte("no timestamp")); ok {
+		t.Errorf("expected lines without timestamps not to be paced")
+	}
+}
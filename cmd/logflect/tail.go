@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/apg/logflect/client"
+	"github.com/apg/logflect/templates"
+)
+
+// Repeatable string flags.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// Tails drains through a session: creates it, streams it, and deletes it
+// on exit. The client reconnects and resumes.
+func runTail(args []string) {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	server := fs.String("url", envOr("LOGFLECT_URL", "http://localhost:9000"), "logflect server base URL")
+	format := fs.String("format", "heroku", "output format: json, or a preset: heroku, short, raw or rfc5424")
+	tmpl := fs.String("template", "", "Go template for each line, over the message's fields, instead of -format")
+	var filters, groups stringList
+	fs.Var(&filters, "filter", "field:type:param filter, e.g. message:contains:error (repeatable)")
+	fs.Var(&groups, "group", "drain group to tail (repeatable)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: logflect tail [flags] drain_id...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 && len(groups) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	request, err := tailRequest(fs.Args(), groups, filters)
+	if err != nil {
+		log.Fatalln("Invalid filter: ", err)
+	}
+
+	line, err := tailTemplate(*format, *tmpl)
+	if err != nil {
+		log.Fatalln("Invalid format: ", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-sigCh
+		cancel()
+	}()
+
+	c := client.New(*server)
+	c.ErrorLog = log.New(os.Stderr, "", log.LstdFlags)
+
+	session, err := c.CreateSession(ctx, request)
+	if err != nil {
+		log.Fatalln("Unable to create session: ", err)
+	}
+
+	stream := c.Stream(ctx, session)
+	for msg := range stream.C {
+		if err := printMessage(os.Stdout, line, msg); err != nil {
+			log.Println("Unable to print message: ", err)
+			cancel()
+		}
+	}
+
+	deleteCtx, cancelDelete := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelDelete()
+	if err := c.DeleteSession(deleteCtx, session); err != nil {
+		log.Println("Unable to delete session: ", err)
+	}
+	if err := stream.Err(); err != nil {
+		log.Fatalln("Unable to tail: ", err)
+	}
+}
+
+// Builds the session to tail from the drains, groups and field:type:param
+// filters given.
+func tailRequest(drainIds, groups, filters []string) (client.SessionRequest, error) {
+	request := client.SessionRequest{DrainIds: drainIds, DrainGroups: groups}
+	for _, raw := range filters {
+		parts := strings.SplitN(raw, ":", 3)
+		if len(parts) != 3 {
+			return request, fmt.Errorf("%q, expected field:type:param", raw)
+		}
+		request.Filters = append(request.Filters, client.Filter{Field: parts[0], Type: parts[1], Param: parts[2]})
+	}
+	return request, nil
+}
+
+// Returns the template for each line, or nil to print JSON.
+func tailTemplate(format, tmpl string) (*template.Template, error) {
+	if tmpl == "" {
+		if format == "json" {
+			return nil, nil
+		}
+		if tmpl = templates.Presets[format]; tmpl == "" {
+			return nil, fmt.Errorf("unknown format %q", format)
+		}
+	}
+	return template.New("line").Funcs(templates.Funcs).Option("missingkey=zero").Parse(tmpl)
+}
+
+func printMessage(w io.Writer, line *template.Template, msg client.Message) error {
+	switch msg.Type {
+	case "gap":
+		log.Printf("Gap: messages %d..%d are no longer buffered", msg.From, msg.To)
+		return nil
+	case "notice":
+		log.Printf("Notice: %s", msg.Message)
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if line == nil {
+		if err := json.NewEncoder(&buf).Encode(msg.Fields); err != nil {
+			return err
+		}
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+
+	fields := msg.Fields
+	for _, name := range []string{"privalversion", "time", "hostname", "name", "procid", "msgid", "message"} {
+		if _, exists := fields[name]; !exists {
+			fields[name] = ""
+		}
+	}
+	fields["message"] = strings.TrimRight(fmt.Sprint(fields["message"]), "\n")
+
+	if err := line.Execute(&buf, fields); err != nil {
+		return err
+	}
+	if msg.Repeated > 0 {
+		fmt.Fprintf(&buf, " [repeated %d times]", msg.Repeated)
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/apg/logflect/client"
+)
+
+func TestTailTemplate(t *testing.T) {
+	fields := map[string]interface{}{
+		"privalversion": "<13>1",
+		"time":          "2012-07-22T00:06:26+00:00",
+		"hostname":      "host",
+		"name":          "app",
+		"procid":        "web.1",
+		"msgid":         "",
+		"message":       "hi",
+	}
+
+	cases := []struct {
+		format, tmpl string
+		expected     string
+		json, err    bool
+	}{
+		{format: "heroku", expected: "2012-07-22T00:06:26+00:00 app[web.1]: hi"},
+		{format: "short", expected: "00:06:26 web.1: hi"},
+		{format: "raw", expected: "hi"},
+		{format: "rfc5424", expected: "<13>1 2012-07-22T00:06:26+00:00 host app web.1 - hi"},
+		{format: "heroku", tmpl: "{{.name}}: {{.message}}", expected: "app: hi"},
+		{format: "json", json: true},
+		{format: "xml", err: true},
+		{format: "heroku", tmpl: "{{.name", err: true},
+	}
+
+	for _, c := range cases {
+		line, err := tailTemplate(c.format, c.tmpl)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s %q: expected an error", c.format, c.tmpl)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %q: unexpected error (%s)", c.format, c.tmpl, err)
+			continue
+		}
+		if c.json {
+			if line != nil {
+				t.Errorf("%s: expected no template, for JSON", c.format)
+			}
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := line.Execute(&buf, fields); err != nil {
+			t.Errorf("%s %q: unexpected error (%s)", c.format, c.tmpl, err)
+		} else if buf.String() != c.expected {
+			t.Errorf("%s %q: expected %q, found %q", c.format, c.tmpl, c.expected, buf.String())
+		}
+	}
+}
+
+func TestPrintMessage(t *testing.T) {
+	heroku, _ := tailTemplate("heroku", "")
+
+	cases := []struct {
+		format   string
+		msg      client.Message
+		expected string
+	}{
+		{
+			format:   "heroku",
+			msg:      client.Message{Repeated: 3, Fields: map[string]interface{}{"time": "T", "name": "app", "procid": "web.1", "message": "hi\n"}},
+			expected: "T app[web.1]: hi [repeated 3 times]\n",
+		},
+		{
+			format:   "heroku",
+			msg:      client.Message{Fields: map[string]interface{}{"message": "only a message"}},
+			expected: " []: only a message\n",
+		},
+		{
+			format:   "json",
+			msg:      client.Message{Fields: map[string]interface{}{"seq": 4, "message": "hi"}},
+			expected: "{\"message\":\"hi\",\"seq\":4}\n",
+		},
+		{
+			format: "heroku",
+			msg:    client.Message{Type: "gap", From: 3, To: 9},
+		},
+		{
+			format: "heroku",
+			msg:    client.Message{Type: "notice", Message: "suppressed 2 lines"},
+		},
+	}
+
+	for i, c := range cases {
+		line := heroku
+		if c.format == "json" {
+			line = nil
+		}
+
+		var buf bytes.Buffer
+		if err := printMessage(&buf, line, c.msg); err != nil {
+			t.Errorf("%d: unexpected error (%s)", i, err)
+		} else if buf.String() != c.expected {
+			t.Errorf("%d: expected %q, found %q", i, c.expected, buf.String())
+		}
+	}
+}
+
+func TestTailRequest(t *testing.T) {
+	cases := []struct {
+		drainIds, groups, filters []string
+		expected                  client.SessionRequest
+		err                       bool
+	}{
+		{
+			drainIds: []string{"d.web"},
+			expected: client.SessionRequest{DrainIds: []string{"d.web"}},
+		},
+		{
+			drainIds: []string{"d.web"},
+			groups:   []string{"prod"},
+			filters:  []string{"message:contains:error", "procid:regexp:^web\\.[0-9]+:x"},
+			expected: client.SessionRequest{
+				DrainIds:    []string{"d.web"},
+				DrainGroups: []string{"prod"},
+				Filters: []client.Filter{
+					{Field: "message", Type: "contains", Param: "error"},
+					{Field: "procid", Type: "regexp", Param: "^web\\.[0-9]+:x"},
+				},
+			},
+		},
+		{
+			drainIds: []string{"d.web"},
+			filters:  []string{"message:error"},
+			err:      true,
+		},
+	}
+
+	for i, c := range cases {
+		request, err := tailRequest(c.drainIds, c.groups, c.filters)
+		if c.err {
+			if err == nil {
+				t.Errorf("%d: expected an error", i)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(request, c.expected) {
+			t.Errorf("%d: expected %+v, found %+v (%v)", i, c.expected, request, err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package logflect
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	ansiReset     = "\x1b[0m"
+	ansiTime      = "\x1b[90m"  // gray
+	ansiHighlight = "\x1b[1;7m" // bold, reversed
+	ansiError     = "\x1b[31m"  // red
+	ansiWarning   = "\x1b[33m"  // yellow
+	ansiDebug     = "\x1b[2m"   // dim
+	ansiRepeated  = "\x1b[2;3m" // dim, italic
+)
+
+// Colors for process names, chosen by hashing so each keeps its color.
+var ansiProcesses = []string{"32", "33", "34", "35", "36", "92", "93", "94", "95", "96"}
+
+// Plain text for terminals: timestamps are grayed out, each process gets
+// its own color, errors and warnings are colored by severity, and what
+// matched the session's filters is highlighted.
+type colorFormatter struct {
+	textFormatter
+	filter Filter
+}
+
+// Returns a formatter which colors text output, highlighting matches of
+// `filter`. Other formats are returned as they are.
+func colorize(f formatter, filter Filter) formatter {
+	if text, ok := f.(textFormatter); ok {
+		return colorFormatter{text, filter}
+	}
+	return f
+}
+
+func (f colorFormatter) Message(w io.Writer, m Message) error {
+	var buf bytes.Buffer
+	if sm, ok := m.(SequencedMessage); ok && f.tagDrains && sm.DrainId != "" {
+		fmt.Fprintf(&buf, "drain=%s ", sm.DrainId)
+	}
+
+	inner := m
+	if sm, ok := inner.(SequencedMessage); ok {
+		inner = sm.Message
+	}
+	repeats := 0
+	if rm, ok := inner.(RepeatedMessage); ok {
+		inner, repeats = rm.Message, rm.Repeats
+	}
+
+	sm, ok := inner.(SyslogMessage)
+	if !ok {
+		// only syslog messages have parts worth coloring
+		buf.WriteString(strings.TrimRight(m.String(), "\n"))
+		buf.WriteByte('\n')
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+
+	if len(sm.Time) > 0 {
+		buf.WriteString(ansiTime + string(sm.Time) + ansiReset + " ")
+	}
+
+	process := string(sm.Name)
+	if len(sm.Procid) > 0 {
+		process += "[" + string(sm.Procid) + "]"
+	}
+	buf.WriteString("\x1b[" + processColor(process) + "m" + process + ":" + ansiReset + " ")
+
+	var spans []MatchSpan
+	if f.filter != nil {
+		for _, span := range filterMatches(f.filter, m) {
+			if span.Field == "message" || span.Field == "Message" {
+				spans = append(spans, span)
+			}
+		}
+	}
+	buf.WriteString(highlight(strings.TrimRight(string(sm.Message), "\n"), spans, severityColor(sm.PrivalVersion)))
+
+	if repeats > 0 {
+		fmt.Fprintf(&buf, " %s[repeated %d times]%s", ansiRepeated, repeats, ansiReset)
+	}
+	buf.WriteByte('\n')
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func processColor(process string) string {
+	h := fnv.New32a()
+	h.Write([]byte(process))
+	return ansiProcesses[h.Sum32()%uint32(len(ansiProcesses))]
+}
+
+// Returns the color for the severity in a `<PRI>VERSION` header, if it's
+// worth drawing attention to.
+func severityColor(privalVersion []byte) string {
+	header := string(privalVersion)
+	end := strings.IndexByte(header, '>')
+	if !strings.HasPrefix(header, "<") || end < 0 {
+		return ""
+	}
+
+	pri, err := strconv.Atoi(header[1:end])
+	if err != nil {
+		return ""
+	}
+	switch severity := pri % 8; {
+	case severity <= 3: // emergency, alert, critical, error
+		return ansiError
+	case severity == 4:
+		return ansiWarning
+	case severity == 7:
+		return ansiDebug
+	default:
+		return ""
+	}
+}
+
+// Renders `text` in `color`, highlighting the spans.
+func highlight(text string, spans []MatchSpan, color string) string {
+	sort.Slice(spans, func(i, j int) bool { return spans[i].Start < spans[j].Start })
+
+	var buf bytes.Buffer
+	buf.WriteString(color)
+	pos := 0
+	for _, span := range spans {
+		start, end := span.Start, span.End
+		if start < pos {
+			start = pos // overlaps the previous span
+		}
+		if end > len(text) {
+			end = len(text)
+		}
+		if start >= end {
+			continue
+		}
+		buf.WriteString(text[pos:start])
+		buf.WriteString(ansiHighlight + text[start:end] + ansiReset + color)
+		pos = end
+	}
+	buf.WriteString(text[pos:])
+	if color != "" {
+		buf.WriteString(ansiReset)
+	}
+	return buf.String()
+}
@@ -0,0 +1,48 @@
+package logflect
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestColorFormatter(t *testing.T) {
+	f := colorize(textFormatter{}, NewContainsFilter("message", "disk"))
+	msg := SequencedMessage{Seq: 1, Message: SyslogMessage{
+		PrivalVersion: []byte("<187>1"),
+		Time:          []byte("2012-07-22T00:06:26+00:00"),
+		Name:          []byte("app"),
+		Procid:        []byte("web.1"),
+		Message:       []byte("disk full\n"),
+	}}
+
+	var buf bytes.Buffer
+	f.Message(&buf, msg)
+
+	expected := "\x1b[90m2012-07-22T00:06:26+00:00\x1b[0m " +
+		"\x1b[" + processColor("app[web.1]") + "mapp[web.1]:\x1b[0m " +
+		"\x1b[31m\x1b[1;7mdisk\x1b[0m\x1b[31m full\x1b[0m\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q, found %q", expected, buf.String())
+	}
+}
+
+func TestColorize_OtherFormats(t *testing.T) {
+	if _, ok := colorize(ndjsonFormatter{}, NewNoFilter()).(ndjsonFormatter); !ok {
+		t.Errorf("expected JSON output not to be colored")
+	}
+}
+
+func TestProcessColor_Stable(t *testing.T) {
+	if processColor("app[web.1]") != processColor("app[web.1]") {
+		t.Errorf("expected a process to keep its color")
+	}
+}
+
+func TestSeverityColor(t *testing.T) {
+	tests := map[string]string{"<187>1": ansiError, "<188>1": ansiWarning, "<190>1": "", "<191>1": ansiDebug, "bogus": ""}
+	for header, expected := range tests {
+		if color := severityColor([]byte(header)); color != expected {
+			t.Errorf("expected %q for %s, found %q", expected, header, color)
+		}
+	}
+}
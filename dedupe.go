@@ -0,0 +1,238 @@
+package logflect
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DedupeFlushInterval = 2 * time.Second // how long a run of consecutive duplicates waits for its summary
+	MaxDedupeEntries    = 10000           // distinct messages tracked in windowed mode
+)
+
+var (
+	dedupeUUID   = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+	dedupeHex    = regexp.MustCompile(`\b[0-9a-fA-F]{16,}\b`)
+	dedupeNumber = regexp.MustCompile(`[0-9]+(\.[0-9]+)?`)
+)
+
+// A message standing in for duplicates that were collapsed: the last of
+// them, and how many there were.
+type RepeatedMessage struct {
+	Message
+	Repeats int
+}
+
+func (m RepeatedMessage) Field(f string) (interface{}, bool) {
+	if f == "repeated" {
+		return m.Repeats, true
+	}
+	return m.Message.Field(f)
+}
+
+func (m RepeatedMessage) String() string {
+	return fmt.Sprintf("%s [repeated %d times]", strings.TrimRight(m.Message.String(), "\n"), m.Repeats)
+}
+
+// Renders the wrapped message's JSON object with a trailing "repeated"
+// count.
+func (m RepeatedMessage) MarshalJSON() ([]byte, error) {
+	inner, err := json.Marshal(m.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(inner) < 2 || inner[0] != '{' {
+		return json.Marshal(map[string]interface{}{"message": json.RawMessage(inner), "repeated": m.Repeats})
+	}
+
+	out := append([]byte{}, inner[:len(inner)-1]...)
+	if len(inner) > 2 {
+		out = append(out, ',')
+	}
+	return append(out, fmt.Sprintf(`"repeated":%d}`, m.Repeats)...), nil
+}
+
+// How a session collapses duplicates.
+type dedupeConfig struct {
+	normalize bool          // ignore numbers, UUIDs and hex ids when comparing
+	window    time.Duration // collapse any duplicate within the window; zero for consecutive ones only
+}
+
+// Collapses duplicate messages, between a session's filter and its
+// streams. The first of a run of duplicates goes through straight away;
+// the rest are counted, and summarized by a RepeatedMessage once the run
+// ends: when a different message arrives (consecutive mode), the window
+// passes (windowed mode), or duplicates stop arriving for a while.
+type deduper struct {
+	config  *dedupeConfig
+	entries map[string]*dedupeEntry
+	flush   func([]Message) // delivers summaries due on the timer
+	timer   *time.Timer
+	stopped bool
+	now     func() time.Time
+	m       *sync.Mutex
+}
+
+type dedupeEntry struct {
+	msg     Message // the last duplicate
+	first   time.Time
+	seen    time.Time
+	repeats int
+}
+
+func newDeduper(config *dedupeConfig, flush func([]Message)) *deduper {
+	return &deduper{
+		config:  config,
+		entries: make(map[string]*dedupeEntry),
+		flush:   flush,
+		now:     time.Now,
+		m:       new(sync.Mutex),
+	}
+}
+
+// Returns the messages to deliver in place of `msg`: nothing if it's a
+// duplicate, otherwise `msg`, preceded by the summary of any run it ends.
+func (d *deduper) admit(msg Message) []Message {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	now := d.now()
+	key := d.key(msg)
+	out := make([]Message, 0, 2)
+
+	if e, exists := d.entries[key]; exists {
+		if d.config.window == 0 || now.Sub(e.first) < d.config.window {
+			e.msg, e.seen = msg, now
+			e.repeats++
+			d.schedule()
+			return nil
+		}
+		out = appendSummary(out, e)
+		delete(d.entries, key)
+	}
+
+	if d.config.window == 0 {
+		for k, e := range d.entries {
+			out = appendSummary(out, e)
+			delete(d.entries, k)
+		}
+	}
+
+	if len(d.entries) < MaxDedupeEntries {
+		d.entries[key] = &dedupeEntry{msg: msg, first: now, seen: now}
+	}
+	if d.config.window > 0 {
+		d.schedule()
+	}
+	return append(out, msg)
+}
+
+// Identifies duplicates: same drain, same process, same text.
+func (d *deduper) key(msg Message) string {
+	text, _ := fieldString(msg, "message")
+	if d.config.normalize {
+		text = dedupeUUID.ReplaceAllString(text, "<uuid>")
+		text = dedupeHex.ReplaceAllString(text, "<hex>")
+		text = dedupeNumber.ReplaceAllString(text, "<n>")
+	}
+
+	var drainId, procid string
+	if sm, ok := msg.(SequencedMessage); ok {
+		drainId = sm.DrainId
+	}
+	if value, ok := msg.Field("procid"); ok {
+		if b, ok := value.([]byte); ok {
+			procid = string(b)
+		}
+	}
+	return drainId + "\x00" + procid + "\x00" + text
+}
+
+// Starts the timer, if it isn't running. Called with d.m held.
+func (d *deduper) schedule() {
+	if d.timer != nil || d.stopped {
+		return
+	}
+
+	interval := d.config.window
+	if interval == 0 {
+		interval = DedupeFlushInterval
+	}
+	d.timer = time.AfterFunc(interval, d.sweep)
+}
+
+// Summarizes the runs which have ended, and keeps the timer going while
+// any are still open.
+func (d *deduper) sweep() {
+	d.m.Lock()
+	d.timer = nil
+
+	now := d.now()
+	var out []Message
+	for key, e := range d.entries {
+		if d.config.window > 0 {
+			if now.Sub(e.first) >= d.config.window {
+				out = appendSummary(out, e)
+				delete(d.entries, key)
+			}
+		} else if e.repeats > 0 && now.Sub(e.seen) >= DedupeFlushInterval {
+			out = appendSummary(out, e)
+			e.repeats = 0
+		}
+	}
+
+	pending := false
+	for _, e := range d.entries {
+		pending = pending || d.config.window > 0 || e.repeats > 0
+	}
+	if pending {
+		d.schedule()
+	}
+	d.m.Unlock()
+
+	if len(out) > 0 {
+		d.flush(out)
+	}
+}
+
+// Summarizes every open run, e.g. at the end of a replayed backlog.
+func (d *deduper) summarize() []Message {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	var out []Message
+	for key, e := range d.entries {
+		out = appendSummary(out, e)
+		delete(d.entries, key)
+	}
+	return out
+}
+
+func (d *deduper) stop() {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	d.stopped = true
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+}
+
+func appendSummary(out []Message, e *dedupeEntry) []Message {
+	if e.repeats == 0 {
+		return out
+	}
+
+	// keep the sequence number on the outside, where streams look for it
+	if sm, ok := e.msg.(SequencedMessage); ok {
+		sm.Message = RepeatedMessage{Message: sm.Message, Repeats: e.repeats}
+		return append(out, sm)
+	}
+	return append(out, RepeatedMessage{Message: e.msg, Repeats: e.repeats})
+}
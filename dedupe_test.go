@@ -0,0 +1,75 @@
+package logflect
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDeduper_Consecutive(t *testing.T) {
+	d := newDeduper(&dedupeConfig{}, func([]Message) {})
+	defer d.stop()
+
+	var out []Message
+	for _, line := range []string{"crash", "crash", "crash", "boot", "crash"} {
+		out = append(out, d.admit(StrMessage(line))...)
+	}
+
+	expected := []string{"crash", "crash [repeated 2 times]", "boot", "crash"}
+	if len(out) != len(expected) {
+		t.Fatalf("expected %v, found %v", expected, out)
+	}
+	for i := range expected {
+		if out[i].String() != expected[i] {
+			t.Errorf("expected %q, found %q", expected[i], out[i])
+		}
+	}
+}
+
+func TestDeduper_NormalizedWindow(t *testing.T) {
+	now := time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)
+	d := newDeduper(&dedupeConfig{normalize: true, window: 10 * time.Second}, func([]Message) {})
+	d.now = func() time.Time { return now }
+	defer d.stop()
+
+	if len(d.admit(StrMessage("request 1 id=6ba7b810-9dad-11d1-80b4-00c04fd430c8 failed"))) != 1 {
+		t.Errorf("expected the first message through")
+	}
+	d.admit(StrMessage("other"))
+	if len(d.admit(StrMessage("request 2 id=6ba7b811-9dad-11d1-80b4-00c04fd430c8 failed"))) != 0 {
+		t.Errorf("expected a normalized duplicate within the window to be collapsed")
+	}
+
+	now = now.Add(10 * time.Second)
+	out := d.admit(StrMessage("request 3 id=6ba7b812-9dad-11d1-80b4-00c04fd430c8 failed"))
+	if len(out) != 2 || out[0].(RepeatedMessage).Repeats != 1 || out[1].String() != "request 3 id=6ba7b812-9dad-11d1-80b4-00c04fd430c8 failed" {
+		t.Errorf("expected a summary and the new message after the window, found %v", out)
+	}
+}
+
+func TestSession_DedupeFlush(t *testing.T) {
+	session := NewSession("drain.id", NoFilter{})
+	session.Dedupe(&dedupeConfig{window: 20 * time.Millisecond})
+	ch := make(chan Message, 10)
+	session.addChannel(ch)
+
+	for i := uint64(1); i <= 3; i++ {
+		session.Publish(SequencedMessage{Seq: i, DrainId: "drain.id", Message: StrMessage("crash")})
+	}
+
+	first := <-ch
+	select {
+	case summary := <-ch:
+		sm, ok := summary.(SequencedMessage)
+		if !ok || sm.Seq != 3 || sm.Message.(RepeatedMessage).Repeats != 2 {
+			t.Errorf("unexpected summary %v", summary)
+		}
+		b, _ := json.Marshal(summary)
+		if string(b) != `{"seq":3,"drain_id":"drain.id","message":"crash","repeated":2}` {
+			t.Errorf("unexpected JSON %s", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected a summary once the window passed, after %v", first)
+	}
+	session.Close()
+}
@@ -17,6 +17,7 @@ type Feed struct {
 	items    *list.List
 	maxCount int
 	maxAge   time.Duration // can't really do anything with maxAge since messages are strings currently.
+	seq      uint64        // sequence number of the last published message
 	sessions map[string]*Session
 	im       *sync.RWMutex // lock for items
 	m        *sync.RWMutex // lock for sessions map
@@ -46,22 +47,89 @@ func (f *Feed) Detach(session *Session) {
 	f.m.Unlock()
 }
 
+// Stamps `msg` with the next sequence number, buffers it and fans it out to
+// attached sessions.
 func (f *Feed) Publish(msg Message) {
 	f.im.Lock()
-	f.items.PushBack(msg)
+	f.seq++
+	smsg := SequencedMessage{Seq: f.seq, DrainId: f.DrainId, Message: msg}
+	f.items.PushBack(smsg)
 	f.im.Unlock()
 
 	f.m.RLock()
 	defer f.m.RUnlock()
 
 	for _, session := range f.sessions {
-		session.Publish(msg)
+		session.Publish(smsg)
 	}
 
 	// TODO: This should probably happen occassionally...
 	f.cleanup() // cleans up old messages
 }
 
+// Scan calls fn for each buffered message, oldest first, or newest first if
+// reverse is set. Scanning stops early if fn returns false.
+func (f *Feed) Scan(reverse bool, fn func(Message) bool) {
+	f.im.RLock()
+	defer f.im.RUnlock()
+
+	if reverse {
+		for e := f.items.Back(); e != nil; e = e.Prev() {
+			if !fn(e.Value.(Message)) {
+				return
+			}
+		}
+	} else {
+		for e := f.items.Front(); e != nil; e = e.Next() {
+			if !fn(e.Value.(Message)) {
+				return
+			}
+		}
+	}
+}
+
+// Returns the sequence number of the last published message.
+func (f *Feed) Seq() uint64 {
+	f.im.RLock()
+	defer f.im.RUnlock()
+	return f.seq
+}
+
+// Returns buffered messages with a sequence number greater than `after`,
+// oldest first. If messages following `after` have already been evicted,
+// `gapFrom` and `gapTo` give the (inclusive) range that was lost; otherwise
+// both are 0.
+func (f *Feed) Since(after uint64) (msgs []Message, gapFrom, gapTo uint64) {
+	f.im.RLock()
+	defer f.im.RUnlock()
+
+	if after >= f.seq {
+		return nil, 0, 0
+	}
+
+	oldest := f.seq + 1
+	if e := f.items.Front(); e != nil {
+		oldest = e.Value.(SequencedMessage).Seq
+	}
+	if after+1 < oldest {
+		gapFrom, gapTo = after+1, oldest-1
+	}
+
+	for e := f.items.Back(); e != nil; e = e.Prev() {
+		if e.Value.(SequencedMessage).Seq <= after {
+			break
+		}
+		msgs = append(msgs, e.Value.(Message))
+	}
+
+	// collected newest first
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+
+	return msgs, gapFrom, gapTo
+}
+
 func (f *Feed) Stale(d time.Duration) bool {
 	// Any sessions?
 	f.m.Lock()
@@ -88,7 +156,7 @@ func (f *Feed) cleanup() {
 	l := f.items.Len()
 
 	for l > f.maxCount {
-		e := f.items.Back()
+		e := f.items.Front()
 		f.items.Remove(e)
 		l--
 	}
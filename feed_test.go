@@ -36,8 +36,36 @@ func TestFeed_Publish(t *testing.T) {
 		t.Errorf("Expected 2 messages, found %d", feed.items.Len())
 	}
 
+	// the oldest message is evicted
 	e := feed.items.Front()
-	if e.Value.(Message) != messages[0] {
-		t.Errorf("'%v' should be equal to '%v'", e.Value.(Message), messages[0])
+	if sm := e.Value.(SequencedMessage); sm.Message != messages[1] || sm.Seq != 2 {
+		t.Errorf("'%v' should be equal to '%v' with seq 2", sm.Message, messages[1])
+	}
+}
+
+func TestFeed_Since(t *testing.T) {
+	feed := NewFeed("drain.id", 3, time.Hour)
+	for _, m := range []string{"message 1", "message 2", "message 3", "message 4", "message 5"} {
+		feed.Publish(StrMessage(m))
+	}
+
+	msgs, gapFrom, gapTo := feed.Since(3)
+	if len(msgs) != 2 || msgs[0].(SequencedMessage).Seq != 4 || msgs[1].(SequencedMessage).Seq != 5 {
+		t.Errorf("unexpected messages after 3: %v", msgs)
+	}
+	if gapFrom != 0 || gapTo != 0 {
+		t.Errorf("unexpected gap %d..%d", gapFrom, gapTo)
+	}
+
+	msgs, gapFrom, gapTo = feed.Since(0)
+	if len(msgs) != 3 {
+		t.Errorf("expected 3 buffered messages, found %d", len(msgs))
+	}
+	if gapFrom != 1 || gapTo != 2 {
+		t.Errorf("expected gap 1..2, found %d..%d", gapFrom, gapTo)
+	}
+
+	if msgs, _, _ = feed.Since(5); len(msgs) != 0 {
+		t.Errorf("expected nothing after the last message, found %v", msgs)
 	}
 }
@@ -9,6 +9,18 @@ type Filter interface {
 	Passes(Message) bool
 }
 
+// Implemented by filters which can say where a message matched them, for
+// highlighting.
+type Matcher interface {
+	Matches(Message) []MatchSpan
+}
+
+// The byte range `[Start, End)` of a field's value which matched a filter.
+type MatchSpan struct {
+	Field      string
+	Start, End int
+}
+
 type NoFilter struct{}
 
 // Ensures a message passes *only* if all `filters` also `Passes()`
@@ -67,13 +79,9 @@ func (f ComboFilter) Passes(m Message) bool {
 
 // Tests msg against filter to see if a given field contains `needle`
 func (f ContainsFilter) Passes(m Message) bool {
-	if value, ok := m.Field(f.field); ok {
-		switch value.(type) {
-		case StrMessage:
-			if s, cok := f.needle.(string); cok {
-				return strings.Contains(string(value.(StrMessage)), s)
-			}
-		default:
+	if value, ok := fieldString(m, f.field); ok {
+		if s, cok := f.needle.(string); cok {
+			return strings.Contains(value, s)
 		}
 	}
 
@@ -81,13 +89,77 @@ func (f ContainsFilter) Passes(m Message) bool {
 }
 
 func (f RegexpFilter) Passes(m Message) bool {
-	if value, ok := m.Field(f.field); ok {
-		switch value.(type) {
+	if value, ok := fieldString(m, f.field); ok {
+		return f.regexp.MatchString(value)
+	}
+
+	return false
+}
+
+// Returns where `m` matched `f`, if `f` can tell.
+func filterMatches(f Filter, m Message) []MatchSpan {
+	if matcher, ok := f.(Matcher); ok {
+		return matcher.Matches(m)
+	}
+	return nil
+}
+
+func (f ComboFilter) Matches(m Message) []MatchSpan {
+	var spans []MatchSpan
+	for _, filter := range f.filters {
+		spans = append(spans, filterMatches(filter, m)...)
+	}
+	return spans
+}
+
+// Returns every occurrence of `needle` in the field.
+func (f ContainsFilter) Matches(m Message) []MatchSpan {
+	value, ok := fieldString(m, f.field)
+	s, cok := f.needle.(string)
+	if !ok || !cok || s == "" {
+		return nil
+	}
+
+	var spans []MatchSpan
+	for offset := 0; ; {
+		i := strings.Index(value[offset:], s)
+		if i < 0 {
+			return spans
+		}
+		start := offset + i
+		spans = append(spans, MatchSpan{f.field, start, start + len(s)})
+		offset = start + len(s)
+	}
+}
+
+func (f RegexpFilter) Matches(m Message) []MatchSpan {
+	value, ok := fieldString(m, f.field)
+	if !ok {
+		return nil
+	}
+
+	var spans []MatchSpan
+	for _, loc := range f.regexp.FindAllStringIndex(value, -1) {
+		if loc[1] > loc[0] {
+			spans = append(spans, MatchSpan{f.field, loc[0], loc[1]})
+		}
+	}
+	return spans
+}
+
+// Returns Message's `field` as a string, if it's a string-like value.
+func fieldString(m Message, field string) (string, bool) {
+	if value, ok := m.Field(field); ok {
+		switch v := value.(type) {
 		case StrMessage:
-			return f.regexp.MatchString(string(value.(StrMessage)))
+			return string(v), true
+		case string:
+			return v, true
+		case []byte:
+			return string(v), true
 		default:
 		}
 	}
 
-	return false
+	return "", false
 }
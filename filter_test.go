@@ -55,3 +55,35 @@ func TestPasses_ComboFilter(t *testing.T) {
 		t.Errorf("neither 'qwijibo' nor 'monkey' are contained within '%s'", msg)
 	}
 }
+
+func TestPasses_SyslogMessageFields(t *testing.T) {
+	msg := SyslogMessage{Name: []byte("router"), Message: []byte("at=error code=H12")}
+
+	if !NewContainsFilter("message", "H12").Passes(msg) {
+		t.Errorf("'H12' is contained in '%s'", msg.Message)
+	}
+
+	if !NewRegexpFilter("name", regexp.MustCompile("^rout")).Passes(msg) {
+		t.Errorf("'^rout' should match '%s'", msg.Name)
+	}
+}
+
+func TestMatches_ComboFilter(t *testing.T) {
+	msg := SyslogMessage{Message: []byte("error: disk error on sda1")}
+	f := NewComboFilter(
+		NewContainsFilter("message", "error"),
+		NewRegexpFilter("message", regexp.MustCompile(`sd[a-z][0-9]*`)),
+		NewNoFilter(),
+	)
+
+	spans := filterMatches(f, msg)
+	expected := []MatchSpan{{"message", 0, 5}, {"message", 12, 17}, {"message", 21, 25}}
+	if len(spans) != len(expected) {
+		t.Fatalf("expected %v, found %v", expected, spans)
+	}
+	for i := range expected {
+		if spans[i] != expected[i] {
+			t.Errorf("expected %v, found %v", expected[i], spans[i])
+		}
+	}
+}
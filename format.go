@@ -0,0 +1,226 @@
+package logflect
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"text/template"
+
+	"github.com/apg/logflect/templates"
+)
+
+var (
+	ErrInvalidFormat = errors.New("Invalid format")
+)
+
+// Renders messages, and markers within a stream, in one of the supported
+// output formats.
+type formatter interface {
+	ContentType() string
+	Message(w io.Writer, m Message) error
+	Gap(w io.Writer, drainId string, from, to uint64) error
+	Notice(w io.Writer, text string) error
+	Heartbeat(w io.Writer) error
+}
+
+// Plain text, one message per line, as rendered by Message.String()
+type textFormatter struct {
+	tagDrains bool // prefix lines with the message's drain
+}
+
+// Plain text, one message per line, rendered by a template over the
+// message's fields.
+type templateFormatter struct {
+	textFormatter
+	tmpl *template.Template
+}
+
+// Newline delimited JSON objects
+type ndjsonFormatter struct{}
+
+// Server-sent events carrying JSON messages, with the sequence number as
+// the event id so EventSource can resume via Last-Event-ID.
+type sseFormatter struct {
+	tagDrains bool // use `drain:seq` event ids
+}
+
+// Returns the formatter called `name`. `tmpl` is the template, or preset,
+// for the "template" format.
+func newFormatter(name, tmpl string) (formatter, error) {
+	switch name {
+	case "", "text":
+		return textFormatter{}, nil
+	case "ndjson", "json":
+		return ndjsonFormatter{}, nil
+	case "sse":
+		return sseFormatter{}, nil
+	case "template":
+		return newTemplateFormatter(tmpl)
+	default:
+		if _, exists := templates.Presets[name]; exists {
+			return newTemplateFormatter(name)
+		}
+		return nil, ErrInvalidFormat
+	}
+}
+
+func newTemplateFormatter(text string) (formatter, error) {
+	if preset, exists := templates.Presets[text]; exists {
+		text = preset
+	}
+	if text == "" {
+		return nil, ErrInvalidFormat
+	}
+
+	tmpl, err := template.New("format").Funcs(templates.Funcs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, ErrInvalidFormat
+	}
+	return templateFormatter{tmpl: tmpl}, nil
+}
+
+// Returns a formatter which identifies the source drain of each message,
+// for streams that merge several feeds. JSON output always includes it.
+func tagDrains(f formatter) formatter {
+	switch f := f.(type) {
+	case textFormatter:
+		return textFormatter{tagDrains: true}
+	case templateFormatter:
+		return templateFormatter{textFormatter{tagDrains: true}, f.tmpl}
+	case colorFormatter:
+		return colorFormatter{textFormatter{tagDrains: true}, f.filter}
+	case sseFormatter:
+		return sseFormatter{tagDrains: true}
+	default:
+		return f
+	}
+}
+
+func (f textFormatter) ContentType() string {
+	return "text/plain; charset=utf-8"
+}
+
+func (f textFormatter) Message(w io.Writer, m Message) error {
+	if sm, ok := m.(SequencedMessage); ok && f.tagDrains && sm.DrainId != "" {
+		_, err := fmt.Fprintf(w, "drain=%s %s\n", sm.DrainId, m)
+		return err
+	}
+	_, err := io.WriteString(w, m.String()+"\n")
+	return err
+}
+
+func (f textFormatter) Gap(w io.Writer, drainId string, from, to uint64) error {
+	if f.tagDrains && drainId != "" {
+		_, err := fmt.Fprintf(w, "gap: drain %s messages %d..%d are no longer buffered\n", drainId, from, to)
+		return err
+	}
+	_, err := fmt.Fprintf(w, "gap: messages %d..%d are no longer buffered\n", from, to)
+	return err
+}
+
+func (f textFormatter) Notice(w io.Writer, text string) error {
+	_, err := fmt.Fprintf(w, "logflect: %s\n", text)
+	return err
+}
+
+func (f textFormatter) Heartbeat(w io.Writer) error {
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func (f templateFormatter) Message(w io.Writer, m Message) error {
+	var buf bytes.Buffer
+	if sm, ok := m.(SequencedMessage); ok && f.tagDrains && sm.DrainId != "" {
+		fmt.Fprintf(&buf, "drain=%s ", sm.DrainId)
+	}
+	prefix := buf.Len()
+	if err := f.tmpl.Execute(&buf, templateData(m)); err != nil {
+		buf.Truncate(prefix)
+		buf.WriteString(err.Error())
+	}
+	_, err := w.Write(append(bytes.TrimRight(buf.Bytes(), "\n"), '\n'))
+	return err
+}
+
+func (f ndjsonFormatter) ContentType() string {
+	return "application/x-ndjson"
+}
+
+func (f ndjsonFormatter) Message(w io.Writer, m Message) error {
+	return json.NewEncoder(w).Encode(m)
+}
+
+func (f ndjsonFormatter) Gap(w io.Writer, drainId string, from, to uint64) error {
+	return json.NewEncoder(w).Encode(gapMarker(drainId, from, to))
+}
+
+func (f ndjsonFormatter) Notice(w io.Writer, text string) error {
+	return json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":    "notice",
+		"message": text,
+	})
+}
+
+func (f ndjsonFormatter) Heartbeat(w io.Writer) error {
+	_, err := io.WriteString(w, `{"type":"heartbeat"}`+"\n")
+	return err
+}
+
+func (f sseFormatter) ContentType() string {
+	return "text/event-stream"
+}
+
+func (f sseFormatter) Message(w io.Writer, m Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	sm, ok := m.(SequencedMessage)
+	switch {
+	case ok && f.tagDrains && sm.DrainId != "":
+		_, err = fmt.Fprintf(w, "id: %s:%d\ndata: %s\n\n", sm.DrainId, sm.Seq, data)
+	case ok:
+		_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", sm.Seq, data)
+	default:
+		_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+	}
+	return err
+}
+
+func (f sseFormatter) Gap(w io.Writer, drainId string, from, to uint64) error {
+	data, err := json.Marshal(gapMarker(drainId, from, to))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: gap\ndata: %s\n\n", data)
+	return err
+}
+
+func (f sseFormatter) Notice(w io.Writer, text string) error {
+	data, err := json.Marshal(text)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: notice\ndata: %s\n\n", data)
+	return err
+}
+
+func (f sseFormatter) Heartbeat(w io.Writer) error {
+	_, err := io.WriteString(w, ": heartbeat\n\n")
+	return err
+}
+
+func gapMarker(drainId string, from, to uint64) map[string]interface{} {
+	gap := map[string]interface{}{
+		"type": "gap",
+		"from": from,
+		"to":   to,
+	}
+	if drainId != "" {
+		gap["drain_id"] = drainId
+	}
+	return gap
+}
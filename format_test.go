@@ -0,0 +1,70 @@
+package logflect
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSseFormatter(t *testing.T) {
+	var buf bytes.Buffer
+	f := sseFormatter{}
+
+	f.Message(&buf, SequencedMessage{Seq: 7, Message: StrMessage("hi")})
+	f.Heartbeat(&buf)
+
+	expected := "id: 7\ndata: {\"seq\":7,\"message\":\"hi\"}\n\n: heartbeat\n\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q, found %q", expected, buf.String())
+	}
+}
+
+func TestTemplateFormatter(t *testing.T) {
+	msg := SequencedMessage{Seq: 3, DrainId: "d.web", Message: SyslogMessage{
+		PrivalVersion: []byte("<190>1"),
+		Time:          []byte("2012-07-22T00:06:26+00:00"),
+		Hostname:      []byte("host"),
+		Name:          []byte("app"),
+		Procid:        []byte("web.1"),
+		Message:       []byte("State changed from starting to up\n"),
+	}}
+
+	tests := []struct {
+		format, tmpl string
+		expected     string
+	}{
+		{"heroku", "", "2012-07-22T00:06:26+00:00 app[web.1]: State changed from starting to up\n"},
+		{"short", "", "00:06:26 web.1: State changed from starting to up\n"},
+		{"raw", "", "State changed from starting to up\n"},
+		{"rfc5424", "", "<190>1 2012-07-22T00:06:26+00:00 host app web.1 - State changed from starting to up\n"},
+		{"template", "heroku", "2012-07-22T00:06:26+00:00 app[web.1]: State changed from starting to up\n"},
+		{"template", "#{{.seq}} {{.name}}", "#3 app\n"},
+	}
+
+	for _, test := range tests {
+		f, err := newFormatter(test.format, test.tmpl)
+		if err != nil {
+			t.Fatalf("unexpected error for %s (%s)", test.format, err)
+		}
+
+		var buf bytes.Buffer
+		f.Message(&buf, msg)
+		if buf.String() != test.expected {
+			t.Errorf("expected %q, found %q", test.expected, buf.String())
+		}
+	}
+
+	var buf bytes.Buffer
+	f, _ := newFormatter("raw", "")
+	tagDrains(f).Message(&buf, msg)
+	if expected := "drain=d.web State changed from starting to up\n"; buf.String() != expected {
+		t.Errorf("expected %q, found %q", expected, buf.String())
+	}
+}
+
+func TestNewFormatter_InvalidTemplate(t *testing.T) {
+	for _, tmpl := range []string{"", "{{.name"} {
+		if _, err := newFormatter("template", tmpl); err != ErrInvalidFormat {
+			t.Errorf("expected ErrInvalidFormat for %q, got %v", tmpl, err)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package logflect
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultForwardBatchSize     = 100
+	MaxForwardBatchSize         = 1000
+	DefaultForwardBatchInterval = time.Second
+	DefaultForwardMaxRetries    = 5
+	ForwardInitialBackoff       = 500 * time.Millisecond
+	ForwardMaxBackoff           = 30 * time.Second
+	ForwardTimeout              = 10 * time.Second
+)
+
+// Where, and how, a forward session pushes its messages.
+type forwardConfig struct {
+	kind          string // "logplex", "syslog" or "webhook"
+	url           *url.URL
+	token         string // sent as Logplex-Drain-Token
+	batchSize     int
+	batchInterval time.Duration
+	maxRetries    int
+}
+
+// Delivers batches of messages to a forward target. `batchId` is the same
+// for every retry of a batch.
+type forwardSink interface {
+	Send(batchId string, batch []Message) error
+	Close() error
+}
+
+// An error retrying won't fix, e.g. a 4xx response.
+type permanentError struct {
+	error
+}
+
+// Pushes a session's messages to a forward target in batches, retrying
+// failed batches with exponential backoff. Runs until the session is
+// closed.
+type Forwarder struct {
+	session *Session
+	config  *forwardConfig
+	sink    forwardSink
+	inbox   chan Message
+	id      uint32
+	backoff time.Duration // initial delay between retries
+	done    chan struct{}
+}
+
+// Attaches a forwarder to `session` and starts it.
+func StartForwarder(session *Session, config *forwardConfig) *Forwarder {
+	f := newForwarder(session, config, newForwardSink(session, config))
+	go f.run()
+	return f
+}
+
+func newForwarder(session *Session, config *forwardConfig, sink forwardSink) *Forwarder {
+	f := &Forwarder{
+		session: session,
+		config:  config,
+		sink:    sink,
+		inbox:   make(chan Message, MaxSessionChannelBacklog),
+		backoff: ForwardInitialBackoff,
+		done:    make(chan struct{}),
+	}
+	f.id = session.addChannel(f.inbox)
+	return f
+}
+
+func newForwardSink(session *Session, config *forwardConfig) forwardSink {
+	switch config.kind {
+	case "syslog":
+		return &syslogSink{url: config.url}
+	default:
+		return &httpSink{
+			kind:    config.kind,
+			url:     config.url.String(),
+			token:   config.token,
+			session: session,
+			client:  &http.Client{Timeout: ForwardTimeout},
+		}
+	}
+}
+
+func (f *Forwarder) run() {
+	defer close(f.done)
+	defer f.sink.Close()
+	defer f.session.removeChannel(f.id)
+
+	ticker := time.NewTicker(f.config.batchInterval)
+	defer ticker.Stop()
+
+	batch := make([]Message, 0, f.config.batchSize)
+	for {
+		select {
+		case msg, open := <-f.inbox:
+			if !open {
+				f.send(batch)
+				return
+			}
+			batch = append(batch, msg)
+			if len(batch) >= f.config.batchSize {
+				f.send(batch)
+				batch = make([]Message, 0, f.config.batchSize)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				f.send(batch)
+				batch = make([]Message, 0, f.config.batchSize)
+			}
+		}
+	}
+}
+
+// Sends `batch`, retrying with exponential backoff up to maxRetries
+// times. Batches which still fail are dropped.
+func (f *Forwarder) send(batch []Message) {
+	if len(batch) == 0 {
+		return
+	}
+
+	batchId := CreateSessionId()
+	delay := f.backoff
+	for attempt := 0; ; attempt++ {
+		err := f.sink.Send(batchId, batch)
+		if err == nil {
+			return
+		}
+
+		_, permanent := err.(permanentError)
+		if permanent || attempt >= f.config.maxRetries {
+			log.Printf("action=forward session_id=%s kind=%s dropped=%d attempts=%d err=%q",
+				f.session.Id, f.config.kind, len(batch), attempt+1, err)
+			return
+		}
+
+		log.Printf("action=forward session_id=%s kind=%s retry_in=%s err=%q", f.session.Id, f.config.kind, delay, err)
+		time.Sleep(delay)
+		if delay *= 2; delay > ForwardMaxBackoff {
+			delay = ForwardMaxBackoff
+		}
+	}
+}
+
+// POSTs batches as Logplex frames, like a Logplex HTTPS drain, or as JSON
+// to a webhook.
+type httpSink struct {
+	kind    string
+	url     string
+	token   string
+	session *Session
+	client  *http.Client
+}
+
+func (s *httpSink) Send(batchId string, batch []Message) error {
+	var body []byte
+	var contentType string
+
+	if s.kind == "webhook" {
+		var err error
+		body, err = json.Marshal(map[string]interface{}{
+			"session_id": s.session.Id,
+			"messages":   batch,
+		})
+		if err != nil {
+			return permanentError{err}
+		}
+		contentType = "application/json"
+	} else {
+		for _, msg := range batch {
+			body = append(body, syslogFrame(msg)...)
+		}
+		contentType = "application/logplex-1"
+	}
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "logflect")
+
+	if s.kind == "logplex" {
+		req.Header.Set("Logplex-Msg-Count", strconv.Itoa(len(batch)))
+		req.Header.Set("Logplex-Frame-Id", batchId)
+		req.Header.Set("Logplex-Drain-Token", s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("Forward target returned %d", resp.StatusCode)
+	default:
+		return permanentError{fmt.Errorf("Forward target returned %d", resp.StatusCode)}
+	}
+}
+
+func (s *httpSink) Close() error {
+	return nil
+}
+
+// Writes batches as octet-counted syslog frames (RFC 6587) over TCP, or
+// TLS for `syslog+tls` URLs, reconnecting after failures.
+type syslogSink struct {
+	url  *url.URL
+	conn net.Conn
+}
+
+func (s *syslogSink) Send(batchId string, batch []Message) error {
+	if s.conn == nil {
+		var err error
+		dialer := &net.Dialer{Timeout: ForwardTimeout}
+		if s.url.Scheme == "syslog+tls" {
+			s.conn, err = tls.DialWithDialer(dialer, "tcp", s.url.Host, &tls.Config{ServerName: s.url.Hostname()})
+		} else {
+			s.conn, err = dialer.Dial("tcp", s.url.Host)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var buf []byte
+	for _, msg := range batch {
+		buf = append(buf, syslogFrame(msg)...)
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(ForwardTimeout))
+	if _, err := s.conn.Write(buf); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *syslogSink) Close() error {
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
+
+// Renders `m` as an octet-counted RFC 5424 frame, with `-` for missing
+// header fields.
+func syslogFrame(m Message) []byte {
+	sm := brokerMessage(m)
+	field := func(b []byte, nilValue string) []byte {
+		if len(b) == 0 {
+			return []byte(nilValue)
+		}
+		return b
+	}
+
+	body := fmt.Sprintf("%s %s %s %s %s %s %s",
+		field(sm.PrivalVersion, "<13>1"),
+		field(sm.Time, "-"),
+		field(sm.Hostname, "-"),
+		field(sm.Name, "-"),
+		field(sm.Procid, "-"),
+		field(sm.Msgid, "-"),
+		sm.Message)
+	return []byte(fmt.Sprintf("%d %s", len(body), body))
+}
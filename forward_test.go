@@ -0,0 +1,208 @@
+package logflect
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testForwardConfig(kind, rawUrl string) *forwardConfig {
+	u, _ := url.Parse(rawUrl)
+	return &forwardConfig{
+		kind:          kind,
+		url:           u,
+		token:         "d.target",
+		batchSize:     2,
+		batchInterval: 10 * time.Millisecond,
+		maxRetries:    3,
+	}
+}
+
+func TestForwarder_Logplex(t *testing.T) {
+	var m sync.Mutex
+	var bodies []string
+	var headers []http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		m.Lock()
+		bodies = append(bodies, string(body))
+		headers = append(headers, r.Header)
+		m.Unlock()
+	}))
+	defer ts.Close()
+
+	session := NewSession("d.token", NoFilter{})
+	f := StartForwarder(session, testForwardConfig("logplex", ts.URL))
+
+	session.Publish(StrMessage("one"))
+	session.Publish(StrMessage("two"))
+	session.Close()
+	<-f.done
+
+	m.Lock()
+	defer m.Unlock()
+	if len(bodies) != 1 {
+		t.Fatalf("expected 1 batch, got %d", len(bodies))
+	}
+	if bodies[0] != "19 <13>1 - - - - - one19 <13>1 - - - - - two" {
+		t.Errorf("unexpected frames %q", bodies[0])
+	}
+	if headers[0].Get("Logplex-Msg-Count") != "2" || headers[0].Get("Logplex-Drain-Token") != "d.target" {
+		t.Errorf("unexpected headers %v", headers[0])
+	}
+}
+
+func TestForwardRequest_LogplexToken(t *testing.T) {
+	fr := &forwardRequest{Type: "logplex", Url: "https://logs.example.com/logs"}
+	if _, err := fr.toConfig(); err != ErrInvalidForward {
+		t.Errorf("expected ErrInvalidForward without a token, got %v", err)
+	}
+
+	fr.Token = "d.target"
+	config, err := fr.toConfig()
+	if err != nil || config.token != "d.target" {
+		t.Errorf("unexpected config %+v (%v)", config, err)
+	}
+}
+
+func TestForwarder_WebhookRetries(t *testing.T) {
+	var m sync.Mutex
+	attempts := 0
+	var received []map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		if attempts++; attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		received = append(received, payload)
+	}))
+	defer ts.Close()
+
+	session := NewSession("drain.id", NoFilter{})
+	f := newForwarder(session, testForwardConfig("webhook", ts.URL), newForwardSink(session, testForwardConfig("webhook", ts.URL)))
+	f.backoff = time.Millisecond
+	go f.run()
+
+	session.Publish(SequencedMessage{Seq: 1, DrainId: "drain.id", Message: StrMessage("hello")})
+	session.Close()
+	<-f.done
+
+	m.Lock()
+	defer m.Unlock()
+	if attempts != 3 || len(received) != 1 {
+		t.Fatalf("expected delivery on the 3rd attempt, got %d attempts, %d deliveries", attempts, len(received))
+	}
+	if received[0]["session_id"] != session.Id {
+		t.Errorf("expected session_id %q, got %v", session.Id, received[0]["session_id"])
+	}
+	msgs, _ := received[0]["messages"].([]interface{})
+	if len(msgs) != 1 || msgs[0].(map[string]interface{})["message"] != "hello" {
+		t.Errorf("unexpected messages %v", msgs)
+	}
+}
+
+func TestForwarder_LogplexRetriesKeepFrameId(t *testing.T) {
+	var m sync.Mutex
+	var frameIds []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		if frameIds = append(frameIds, r.Header.Get("Logplex-Frame-Id")); len(frameIds) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	session := NewSession("drain.id", NoFilter{})
+	f := newForwarder(session, testForwardConfig("logplex", ts.URL), newForwardSink(session, testForwardConfig("logplex", ts.URL)))
+	f.backoff = time.Millisecond
+	go f.run()
+
+	session.Publish(StrMessage("one"))
+	session.Close()
+	<-f.done
+
+	m.Lock()
+	defer m.Unlock()
+	if len(frameIds) != 3 || frameIds[0] == "" || frameIds[1] != frameIds[0] || frameIds[2] != frameIds[0] {
+		t.Errorf("expected every retry to send the same frame id, found %v", frameIds)
+	}
+}
+
+func TestForwarder_PermanentFailure(t *testing.T) {
+	var m sync.Mutex
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		attempts++
+		m.Unlock()
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	session := NewSession("drain.id", NoFilter{})
+	f := StartForwarder(session, testForwardConfig("webhook", ts.URL))
+	session.Publish(StrMessage("hello"))
+	session.Close()
+	<-f.done
+
+	m.Lock()
+	defer m.Unlock()
+	if attempts != 1 {
+		t.Errorf("expected a 4xx not to be retried, got %d attempts", attempts)
+	}
+}
+
+func TestForwarder_Syslog(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	lines := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := ioutil.ReadAll(bufio.NewReader(conn))
+		lines <- string(data)
+	}()
+
+	session := NewSession("drain.id", NoFilter{})
+	f := StartForwarder(session, testForwardConfig("syslog", "syslog://"+ln.Addr().String()))
+	session.Publish(SyslogMessage{
+		PrivalVersion: []byte("<190>1"),
+		Time:          []byte("2012-07-22T00:06:26+00:00"),
+		Hostname:      []byte("host"),
+		Name:          []byte("app"),
+		Procid:        []byte("web.1"),
+		Msgid:         []byte("-"),
+		Message:       []byte("hello"),
+	})
+	session.Close()
+	<-f.done
+
+	select {
+	case data := <-lines:
+		if !strings.HasSuffix(data, "<190>1 2012-07-22T00:06:26+00:00 host app web.1 - hello") || !strings.HasPrefix(data, "55 ") {
+			t.Errorf("unexpected frame %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("syslog receiver got nothing")
+	}
+}
@@ -0,0 +1,334 @@
+package logflect
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"mime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bmizerany/lpx"
+)
+
+const LogplexContentType = "application/logplex-1"
+
+// Defaults for the -frame-id-ttl and -frame-ids flags.
+const (
+	DefaultFrameIdTTL       = 5 * time.Minute // how long a batch's frame id is remembered, to spot retries
+	DefaultFrameIdsPerDrain = 1000            // frame ids remembered per drain
+)
+
+// TODO: Should be config parameters
+const (
+	IngestWorkers    = 8   // goroutines publishing ingested batches
+	IngestQueueSize  = 256 // batches waiting per worker
+	IngestRetryAfter = 1   // seconds Logplex is asked to wait when the queue is full
+)
+
+var (
+	ErrInvalidContentType = errors.New("Invalid content type")
+	ErrMsgCountMismatch   = errors.New("Message count doesn't match Logplex-Msg-Count")
+	ErrGarbledFrame       = errors.New("Garbled frame")
+	ErrIngestQueueFull    = errors.New("Ingest queue full")
+	ErrIngestClosed       = errors.New("Ingest queue closed")
+)
+
+// Why a batch wasn't parsed: what went wrong, after how many frames, and
+// where in the body.
+type frameError struct {
+	err    error
+	frames int
+	offset int64
+}
+
+func (e *frameError) Error() string {
+	return fmt.Sprintf("%s after %d frames at byte %d", e.err, e.frames, e.offset)
+}
+
+// Counts ingested batches and why any were rejected.
+type ingestStats struct {
+	batches    uint64 // accessed atomically, as are the rest
+	messages   uint64
+	badType    uint64
+	garbled    uint64
+	miscounted uint64
+	queueFull  uint64
+	duplicates uint64
+	failed     uint64 // messages accepted, but not published
+}
+
+// A parsed batch, waiting to be published.
+type ingestBatch struct {
+	drainId string
+	frameId string
+	msgs    []Message
+}
+
+// Publishes batches off the request path. Batches are sharded across
+// workers by drain, so each drain's messages stay in order.
+type ingestQueue struct {
+	shards  []chan ingestBatch
+	publish func(ingestBatch)
+	closed  bool
+	stopped int32 // accessed atomically; set when what's queued should be dropped
+	wg      sync.WaitGroup
+	m       *sync.RWMutex // held to send on shards, and to close them
+}
+
+// Remembers the frame ids of recently accepted batches: the latest `size`
+// of each drain, for up to `ttl`.
+type frameIds struct {
+	drains    map[string]*frameLRU
+	size      int
+	ttl       time.Duration
+	lastSweep time.Time
+	now       func() time.Time
+	m         *sync.Mutex
+}
+
+// A drain's frame ids, most recently seen first.
+type frameLRU struct {
+	order *list.List
+	ids   map[string]*list.Element
+}
+
+type frameEntry struct {
+	id string
+	at time.Time // when the batch was accepted
+}
+
+// Counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Checks an ingest request's Content-Type, which Logplex sets, but may be
+// left out by other clients.
+func validContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == LogplexContentType
+}
+
+// Parses every frame of a Logplex batch, checking the count against
+// `msgCount` if it's given. Nothing is returned if any frame is garbled.
+func readFrames(body io.Reader, msgCount string) ([]Message, error) {
+	counted := &countingReader{r: body}
+	br := bufio.NewReader(counted)
+	lp := lpx.NewReader(br)
+
+	var msgs []Message
+	for lp.Next() {
+		msgs = append(msgs, lpToMessage(lp))
+	}
+	if err := lp.Err(); err != nil {
+		return nil, &frameError{err: ErrGarbledFrame, frames: len(msgs), offset: counted.n - int64(br.Buffered())}
+	}
+
+	if msgCount != "" {
+		if n, err := strconv.Atoi(msgCount); err != nil || n != len(msgs) {
+			return nil, ErrMsgCountMismatch
+		}
+	}
+	return msgs, nil
+}
+
+func newFrameIds(size int, ttl time.Duration) *frameIds {
+	return &frameIds{
+		drains: make(map[string]*frameLRU),
+		size:   size,
+		ttl:    ttl,
+		now:    time.Now,
+		m:      new(sync.Mutex),
+	}
+}
+
+// Records a batch's frame id, reporting whether it was already accepted.
+func (f *frameIds) Seen(drainId, frameId string) bool {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	now := f.now()
+	if now.Sub(f.lastSweep) > f.ttl {
+		f.sweep(now)
+	}
+
+	lru, exists := f.drains[drainId]
+	if !exists {
+		lru = &frameLRU{order: list.New(), ids: make(map[string]*list.Element)}
+		f.drains[drainId] = lru
+	}
+
+	if e, exists := lru.ids[frameId]; exists {
+		if now.Sub(e.Value.(*frameEntry).at) <= f.ttl {
+			lru.order.MoveToFront(e)
+			return true
+		}
+		lru.remove(e)
+	}
+
+	lru.ids[frameId] = lru.order.PushFront(&frameEntry{id: frameId, at: now})
+	for lru.order.Len() > f.size {
+		lru.remove(lru.order.Back())
+	}
+	return false
+}
+
+// Forgets a frame id, so a retry of a batch which failed is accepted.
+func (f *frameIds) Forget(drainId, frameId string) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if lru, exists := f.drains[drainId]; exists {
+		if e, exists := lru.ids[frameId]; exists {
+			lru.remove(e)
+		}
+		if lru.order.Len() == 0 {
+			delete(f.drains, drainId)
+		}
+	}
+}
+
+// Drops expired frame ids, and drains left without any. Called with f.m
+// held.
+func (f *frameIds) sweep(now time.Time) {
+	for drainId, lru := range f.drains {
+		for e := lru.order.Back(); e != nil; e = lru.order.Back() {
+			if now.Sub(e.Value.(*frameEntry).at) <= f.ttl {
+				break
+			}
+			lru.remove(e)
+		}
+		if lru.order.Len() == 0 {
+			delete(f.drains, drainId)
+		}
+	}
+	f.lastSweep = now
+}
+
+func (l *frameLRU) remove(e *list.Element) {
+	l.order.Remove(e)
+	delete(l.ids, e.Value.(*frameEntry).id)
+}
+
+func newIngestQueue(workers, size int, publish func(ingestBatch)) *ingestQueue {
+	q := &ingestQueue{shards: make([]chan ingestBatch, workers), publish: publish, m: new(sync.RWMutex)}
+	for i := range q.shards {
+		q.shards[i] = make(chan ingestBatch, size)
+		q.wg.Add(1)
+		go q.work(q.shards[i])
+	}
+	return q
+}
+
+// Queues a batch for its drain's worker, or returns ErrIngestQueueFull
+// without waiting. Returns ErrIngestClosed once the queue is closed.
+func (q *ingestQueue) Enqueue(b ingestBatch) error {
+	h := fnv.New32a()
+	h.Write([]byte(b.drainId))
+
+	q.m.RLock()
+	defer q.m.RUnlock()
+	if q.closed {
+		return ErrIngestClosed
+	}
+
+	select {
+	case q.shards[h.Sum32()%uint32(len(q.shards))] <- b:
+		return nil
+	default:
+		return ErrIngestQueueFull
+	}
+}
+
+// Returns the number of batches waiting.
+func (q *ingestQueue) Len() int {
+	n := 0
+	for _, shard := range q.shards {
+		n += len(shard)
+	}
+	return n
+}
+
+// Stops taking batches, publishes what's queued, then stops the workers.
+func (q *ingestQueue) Close() {
+	q.shutdown(false)
+}
+
+// Like Close, but what's queued is dropped rather than published.
+func (q *ingestQueue) Stop() {
+	q.shutdown(true)
+}
+
+func (q *ingestQueue) shutdown(drop bool) {
+	q.m.Lock()
+	if drop {
+		atomic.StoreInt32(&q.stopped, 1)
+	}
+	if !q.closed {
+		q.closed = true
+		for _, shard := range q.shards {
+			close(shard)
+		}
+	}
+	q.m.Unlock()
+	q.wg.Wait()
+}
+
+// Reports whether batches are being dropped, which publish checks.
+func (q *ingestQueue) Stopped() bool {
+	return atomic.LoadInt32(&q.stopped) == 1
+}
+
+func (q *ingestQueue) work(shard chan ingestBatch) {
+	defer q.wg.Done()
+	for b := range shard {
+		q.publish(b)
+	}
+}
+
+func (s *ingestStats) WritePrometheus(w io.Writer) error {
+	_, err := fmt.Fprintf(w, `# HELP logflect_ingest_batches_total Logplex batches accepted.
+# TYPE logflect_ingest_batches_total counter
+logflect_ingest_batches_total %d
+# HELP logflect_ingest_messages_total Messages accepted.
+# TYPE logflect_ingest_messages_total counter
+logflect_ingest_messages_total %d
+# HELP logflect_ingest_rejected_total Logplex batches rejected, by reason.
+# TYPE logflect_ingest_rejected_total counter
+logflect_ingest_rejected_total{reason="content_type"} %d
+logflect_ingest_rejected_total{reason="garbled"} %d
+logflect_ingest_rejected_total{reason="msg_count"} %d
+logflect_ingest_rejected_total{reason="queue_full"} %d
+# HELP logflect_ingest_duplicates_total Retried Logplex batches skipped by frame id.
+# TYPE logflect_ingest_duplicates_total counter
+logflect_ingest_duplicates_total %d
+# HELP logflect_ingest_failed_total Messages accepted but not published.
+# TYPE logflect_ingest_failed_total counter
+logflect_ingest_failed_total %d
+`,
+		atomic.LoadUint64(&s.batches),
+		atomic.LoadUint64(&s.messages),
+		atomic.LoadUint64(&s.badType),
+		atomic.LoadUint64(&s.garbled),
+		atomic.LoadUint64(&s.miscounted),
+		atomic.LoadUint64(&s.queueFull),
+		atomic.LoadUint64(&s.duplicates),
+		atomic.LoadUint64(&s.failed))
+	return err
+}
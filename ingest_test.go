@@ -0,0 +1,223 @@
+package logflect
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testFrame = "<174>1 2012-07-22T00:06:26-00:00 somehost app web.1 - Hi"
+
+func testBatch(n int) string {
+	return strings.Repeat(fmt.Sprintf("%d %s", len(testFrame), testFrame), n)
+}
+
+func TestReadFrames(t *testing.T) {
+	msgs, err := readFrames(strings.NewReader(testBatch(2)), "2")
+	if err != nil || len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, found %d (%v)", len(msgs), err)
+	}
+
+	if _, err := readFrames(strings.NewReader(testBatch(2)), "3"); err != ErrMsgCountMismatch {
+		t.Errorf("expected ErrMsgCountMismatch, got %v", err)
+	}
+
+	_, err = readFrames(strings.NewReader(testBatch(1)+"80 <174>1 truncated"), "")
+	fe, ok := err.(*frameError)
+	if !ok || fe.err != ErrGarbledFrame || fe.frames != 1 || fe.offset <= 0 {
+		t.Errorf("expected a garbled frame after 1 frame, got %v", err)
+	}
+}
+
+func TestFrameIds_Seen(t *testing.T) {
+	now := time.Now()
+	f := newFrameIds(2, time.Minute)
+	f.now = func() time.Time { return now }
+
+	if f.Seen("d.web", "f1") {
+		t.Errorf("expected a new frame id not to be seen")
+	}
+	if !f.Seen("d.web", "f1") {
+		t.Errorf("expected a retried frame id to be seen")
+	}
+	if f.Seen("d.api", "f1") {
+		t.Errorf("expected frame ids to be per drain")
+	}
+
+	f.Forget("d.web", "f1")
+	if f.Seen("d.web", "f1") {
+		t.Errorf("expected a forgotten frame id not to be seen")
+	}
+
+	// f1 was seen most recently, so f2 is evicted for f3
+	f.Seen("d.web", "f2")
+	f.Seen("d.web", "f1")
+	f.Seen("d.web", "f3")
+	if f.Seen("d.web", "f2") {
+		t.Errorf("expected the least recently seen frame id to be evicted")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if f.Seen("d.web", "f3") {
+		t.Errorf("expected frame ids to expire")
+	}
+	if _, exists := f.drains["d.api"]; exists {
+		t.Errorf("expected drains without frame ids to be dropped")
+	}
+}
+
+func TestApi_LogsValidation(t *testing.T) {
+	store := NewStore(time.Hour, time.Hour)
+	api := NewApi(store, &http.Server{})
+
+	post := func(body string, headers map[string]string) int {
+		r := httptest.NewRequest("POST", "/v1/logs", strings.NewReader(body))
+		r.Header.Set("Logplex-Drain-Token", "d.web")
+		for name, value := range headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	headers := map[string]string{"Content-Type": LogplexContentType, "Logplex-Msg-Count": "2", "Logplex-Frame-Id": "f1"}
+	if code := post(testBatch(2), headers); code != http.StatusAccepted {
+		t.Errorf("expected 202, found %d", code)
+	}
+	if code := post(testBatch(2), headers); code != http.StatusAccepted {
+		t.Errorf("expected 202 for a retry, found %d", code)
+	}
+	api.Wait()
+	if msgs, _, _ := store.getFeed("d.web").Since(0); len(msgs) != 2 {
+		t.Errorf("expected the retry to be skipped, found %d messages", len(msgs))
+	}
+
+	if code := post(testBatch(1), map[string]string{"Logplex-Msg-Count": "2"}); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a short batch, found %d", code)
+	}
+	if code := post(testBatch(1)+"99 <13>1", nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a garbled batch, found %d", code)
+	}
+	if code := post(testBatch(1), map[string]string{"Content-Type": "application/x-www-form-urlencoded"}); code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected 415, found %d", code)
+	}
+	api.Wait()
+	if msgs, _, _ := store.getFeed("d.web").Since(0); len(msgs) != 2 {
+		t.Errorf("expected rejected batches not to be published, found %d messages", len(msgs))
+	}
+
+	var b strings.Builder
+	store.WriteMetrics(&b)
+	for _, line := range []string{
+		"logflect_ingest_batches_total 1\n",
+		`logflect_ingest_rejected_total{reason="garbled"} 1`,
+		`logflect_ingest_rejected_total{reason="msg_count"} 1`,
+		`logflect_ingest_rejected_total{reason="content_type"} 1`,
+		"logflect_ingest_duplicates_total 1\n",
+	} {
+		if !strings.Contains(b.String(), line) {
+			t.Errorf("expected %q in metrics", line)
+		}
+	}
+}
+
+func TestIngestQueue_Full(t *testing.T) {
+	taken, release := make(chan struct{}, 1), make(chan struct{})
+	var published []string
+	q := newIngestQueue(1, 1, func(b ingestBatch) {
+		taken <- struct{}{}
+		<-release
+		published = append(published, b.frameId)
+	})
+
+	// the worker holds the first batch, the shard the second
+	if err := q.Enqueue(ingestBatch{drainId: "d.web", frameId: "f1"}); err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	<-taken
+	var err error
+	for i := 2; err == nil && i < 10; i++ {
+		err = q.Enqueue(ingestBatch{drainId: "d.web", frameId: fmt.Sprintf("f%d", i)})
+	}
+	if err != ErrIngestQueueFull {
+		t.Errorf("expected ErrIngestQueueFull, got %v", err)
+	}
+
+	close(release)
+	go func() {
+		for range taken {
+		}
+	}()
+	q.Close()
+	close(taken)
+	if len(published) < 2 || published[0] != "f1" || published[1] != "f2" {
+		t.Errorf("expected batches published in order, found %v", published)
+	}
+}
+
+func TestApi_LogsQueueFull(t *testing.T) {
+	store := NewStore(time.Hour, time.Hour)
+	api := NewApi(store, &http.Server{})
+	api.queue = newIngestQueue(1, 0, func(ingestBatch) {})
+	api.queue.shards[0] = make(chan ingestBatch) // nothing receives
+
+	r := httptest.NewRequest("POST", "/v1/logs", strings.NewReader(testBatch(1)))
+	r.Header.Set("Logplex-Drain-Token", "d.web")
+	r.Header.Set("Logplex-Frame-Id", "f1")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 429 with Retry-After, found %d %v", w.Code, w.Header())
+	}
+	if store.frames.Seen("d.web", "f1") {
+		t.Errorf("expected the frame id of a refused batch to be forgotten")
+	}
+}
+
+func TestIngestQueue_Stop(t *testing.T) {
+	taken, release := make(chan struct{}, 1), make(chan struct{})
+	var q *ingestQueue
+	var published []string
+	q = newIngestQueue(1, 2, func(b ingestBatch) {
+		taken <- struct{}{}
+		<-release
+		if !q.Stopped() {
+			published = append(published, b.frameId)
+		}
+	})
+
+	for _, frameId := range []string{"f1", "f2"} {
+		if err := q.Enqueue(ingestBatch{drainId: "d.web", frameId: frameId}); err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+	}
+	<-taken
+
+	stopped := make(chan struct{})
+	go func() {
+		q.Stop()
+		close(stopped)
+	}()
+	for !q.Stopped() {
+		time.Sleep(time.Millisecond)
+	}
+	if err := q.Enqueue(ingestBatch{drainId: "d.web", frameId: "f3"}); err != ErrIngestClosed {
+		t.Errorf("expected ErrIngestClosed, got %v", err)
+	}
+
+	close(release)
+	go func() {
+		for range taken {
+		}
+	}()
+	<-stopped
+	close(taken)
+	if len(published) != 0 {
+		t.Errorf("expected queued batches to be dropped, found %v", published)
+	}
+}
@@ -0,0 +1,111 @@
+package logflect
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SuppressedNoticeInterval = 5 * time.Second
+)
+
+var (
+	ErrInvalidSample = errors.New("Invalid sample")
+)
+
+// Keeps a deterministic fraction of messages: those whose `by` field
+// hashes below the fraction, so related lines (e.g. of one request) are
+// kept or dropped together.
+type sampler struct {
+	keep  uint32 // keep `keep` in every `outOf`
+	outOf uint32
+	by    string
+}
+
+// Parses a sample rate, either `1/N` or a percentage like `10%` or
+// `0.5%`, of messages grouped by the `by` field (the message, by default).
+func newSampler(rate, by string) (*sampler, error) {
+	s := &sampler{by: by}
+	if s.by == "" {
+		s.by = "message"
+	}
+
+	if strings.HasSuffix(rate, "%") {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(rate, "%"), 64)
+		if err != nil || pct <= 0 || pct > 100 {
+			return nil, ErrInvalidSample
+		}
+		s.keep, s.outOf = uint32(pct*100), 10000
+	} else if parts := strings.SplitN(rate, "/", 2); len(parts) == 2 {
+		keep, err1 := strconv.ParseUint(parts[0], 10, 32)
+		outOf, err2 := strconv.ParseUint(parts[1], 10, 32)
+		if err1 != nil || err2 != nil || keep == 0 || keep > outOf {
+			return nil, ErrInvalidSample
+		}
+		s.keep, s.outOf = uint32(keep), uint32(outOf)
+	} else {
+		return nil, ErrInvalidSample
+	}
+
+	if s.keep == 0 {
+		return nil, ErrInvalidSample
+	}
+	return s, nil
+}
+
+func (s *sampler) keeps(m Message) bool {
+	value, ok := fieldString(m, s.by)
+	if !ok {
+		value = m.String()
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	return h.Sum32()%s.outOf < s.keep
+}
+
+// A token bucket allowing `rate` messages per second, in bursts of up to
+// one second's worth, or of one message for rates below one per second.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	m      *sync.Mutex
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	burst := math.Max(rate, 1)
+	return &rateLimiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+		now:    time.Now,
+		m:      new(sync.Mutex),
+	}
+}
+
+func (l *rateLimiter) allow() bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	now := l.now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
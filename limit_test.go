@@ -0,0 +1,95 @@
+package logflect
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNewSampler(t *testing.T) {
+	for rate, expected := range map[string][2]uint32{"1/10": {1, 10}, "10%": {1000, 10000}, "0.5%": {50, 10000}, "100%": {10000, 10000}} {
+		s, err := newSampler(rate, "")
+		if err != nil {
+			t.Errorf("unexpected error for %q (%s)", rate, err)
+			continue
+		}
+		if s.keep != expected[0] || s.outOf != expected[1] || s.by != "message" {
+			t.Errorf("unexpected sampler for %q: %+v", rate, s)
+		}
+	}
+
+	for _, rate := range []string{"", "10", "0%", "101%", "0/10", "2/1", "a/b"} {
+		if _, err := newSampler(rate, ""); err != ErrInvalidSample {
+			t.Errorf("expected ErrInvalidSample for %q, got %v", rate, err)
+		}
+	}
+}
+
+func TestSampler_Keeps(t *testing.T) {
+	s, _ := newSampler("1/4", "kv.request_id")
+
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		msg := StrMessage(fmt.Sprintf("request_id=%d at=start", i))
+		keeps := s.keeps(msg)
+		if keeps {
+			kept++
+		}
+		if s.keeps(StrMessage(fmt.Sprintf("request_id=%d at=finish", i))) != keeps {
+			t.Fatalf("expected lines of request %d to be sampled together", i)
+		}
+	}
+	if kept < 200 || kept > 300 {
+		t.Errorf("expected about 250 of 1000 kept, found %d", kept)
+	}
+}
+
+func TestRateLimiter_Allow(t *testing.T) {
+	now := time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)
+	l := newRateLimiter(10)
+	l.now = func() time.Time { return now }
+	l.last = now
+
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		if l.allow() {
+			allowed++
+		}
+	}
+	if allowed != 10 {
+		t.Errorf("expected a burst of 10, found %d", allowed)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	allowed = 0
+	for i := 0; i < 20; i++ {
+		if l.allow() {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("expected 5 after half a second, found %d", allowed)
+	}
+}
+
+func TestRateLimiter_AllowFractional(t *testing.T) {
+	now := time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)
+	l := newRateLimiter(0.5)
+	l.now = func() time.Time { return now }
+	l.last = now
+
+	for i, expected := range []bool{true, false} {
+		if l.allow() != expected {
+			t.Errorf("line %d: expected allowed=%t", i, expected)
+		}
+	}
+
+	now = now.Add(time.Second)
+	if l.allow() {
+		t.Errorf("expected nothing allowed after one second")
+	}
+	now = now.Add(time.Second)
+	if !l.allow() {
+		t.Errorf("expected a line allowed after two seconds")
+	}
+}
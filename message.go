@@ -1,6 +1,11 @@
 package logflect
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
 
 type Message interface {
 	Field(n string) (interface{}, bool)
@@ -9,6 +14,14 @@ type Message interface {
 
 type StrMessage string
 
+// A Message stamped with its position in a Feed. Sequence numbers are per
+// drain and increase monotonically with each publish.
+type SequencedMessage struct {
+	Seq     uint64
+	DrainId string
+	Message
+}
+
 type SyslogMessage struct {
 	PrivalVersion []byte
 	Time          []byte
@@ -20,6 +33,9 @@ type SyslogMessage struct {
 }
 
 func (s StrMessage) Field(f string) (interface{}, bool) {
+	if strings.HasPrefix(f, "kv.") {
+		return kvField(string(s), f[3:])
+	}
 	return s, true
 }
 
@@ -27,6 +43,10 @@ func (s StrMessage) String() string {
 	return string(s)
 }
 
+func (s StrMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{"message": string(s)})
+}
+
 func (s SyslogMessage) Field(f string) (interface{}, bool) {
 	switch f {
 	case "PrivalVersion", "privalVersion", "privalversion":
@@ -44,6 +64,9 @@ func (s SyslogMessage) Field(f string) (interface{}, bool) {
 	case "Message", "message":
 		return string(s.Message), true
 	default:
+		if strings.HasPrefix(f, "kv.") {
+			return kvField(string(s.Message), f[3:])
+		}
 		return "", false
 	}
 }
@@ -52,3 +75,155 @@ func (s SyslogMessage) String() string {
 	tmp := fmt.Sprintf("%s %s %s %s %s %s %s\n", s.PrivalVersion, s.Time, s.Hostname, s.Name, s.Procid, s.Msgid, s.Message)
 	return fmt.Sprintf("%d %s\n", len(tmp), tmp)
 }
+
+// Renders the message with string fields rather than base64'd byte slices.
+func (s SyslogMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{
+		"privalversion": string(s.PrivalVersion),
+		"time":          string(s.Time),
+		"hostname":      string(s.Hostname),
+		"name":          string(s.Name),
+		"procid":        string(s.Procid),
+		"msgid":         string(s.Msgid),
+		"message":       string(s.Message),
+	})
+}
+
+// Reads the message as rendered by MarshalJSON.
+func (s *SyslogMessage) UnmarshalJSON(data []byte) error {
+	fields := make(map[string]string)
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	s.PrivalVersion = []byte(fields["privalversion"])
+	s.Time = []byte(fields["time"])
+	s.Hostname = []byte(fields["hostname"])
+	s.Name = []byte(fields["name"])
+	s.Procid = []byte(fields["procid"])
+	s.Msgid = []byte(fields["msgid"])
+	s.Message = []byte(fields["message"])
+	return nil
+}
+
+func (s SequencedMessage) Field(f string) (interface{}, bool) {
+	switch f {
+	case "Seq", "seq":
+		return s.Seq, true
+	case "DrainId", "drainId", "drain_id":
+		return s.DrainId, true
+	default:
+		return s.Message.Field(f)
+	}
+}
+
+func (s SequencedMessage) String() string {
+	return fmt.Sprintf("seq=%d %s", s.Seq, s.Message)
+}
+
+// Renders the wrapped message's JSON object with leading "seq" and
+// "drain_id" keys.
+func (s SequencedMessage) MarshalJSON() ([]byte, error) {
+	inner, err := json.Marshal(s.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(inner) < 2 || inner[0] != '{' {
+		return json.Marshal(map[string]interface{}{"seq": s.Seq, "drain_id": s.DrainId, "message": json.RawMessage(inner)})
+	}
+
+	out := []byte(fmt.Sprintf(`{"seq":%d`, s.Seq))
+	if s.DrainId != "" {
+		drainId, _ := json.Marshal(s.DrainId)
+		out = append(append(out, `,"drain_id":`...), drainId...)
+	}
+	if len(inner) > 2 {
+		out = append(out, ',')
+	}
+	return append(out, inner[1:]...), nil
+}
+
+// Returns the sequence number of `m`, if it has been through a Feed.
+func messageSeq(m Message) (uint64, bool) {
+	if sm, ok := m.(SequencedMessage); ok {
+		return sm.Seq, true
+	}
+	return 0, false
+}
+
+// Returns the parsed timestamp of `m`, if it has one.
+func messageTime(m Message) (time.Time, bool) {
+	value, ok := m.Field("time")
+	if !ok {
+		return time.Time{}, false
+	}
+
+	raw, ok := value.([]byte)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, string(raw))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// Looks up `key` among the logfmt-style `key=value` pairs in `text`, as
+// used for `kv.<key>` fields.
+func kvField(text, key string) (interface{}, bool) {
+	var value string
+	found := false
+	scanKV(text, func(k, v string) bool {
+		if k == key {
+			value, found = v, true
+			return false
+		}
+		return true
+	})
+	return value, found
+}
+
+// Calls `fn` with each logfmt-style `key=value` pair in `text`, until it
+// returns false. Values may be double quoted; bare words are skipped.
+func scanKV(text string, fn func(key, value string) bool) {
+	for len(text) > 0 {
+		text = strings.TrimLeft(text, " ")
+
+		end := strings.IndexAny(text, "= ")
+		if end < 0 {
+			return
+		}
+		key := text[:end]
+		if text[end] == ' ' {
+			text = text[end:]
+			continue
+		}
+		text = text[end+1:]
+
+		var value string
+		if strings.HasPrefix(text, `"`) {
+			closing := 1
+			for closing < len(text) && (text[closing] != '"' || text[closing-1] == '\\') {
+				closing++
+			}
+			value = strings.Replace(text[1:closing], `\"`, `"`, -1)
+			if closing < len(text) {
+				closing++
+			}
+			text = text[closing:]
+		} else {
+			if space := strings.IndexByte(text, ' '); space >= 0 {
+				value, text = text[:space], text[space:]
+			} else {
+				value, text = text, ""
+			}
+		}
+
+		if !fn(key, value) {
+			return
+		}
+	}
+}
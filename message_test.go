@@ -0,0 +1,35 @@
+package logflect
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSequencedMessage_MarshalJSON(t *testing.T) {
+	msg := SequencedMessage{Seq: 42, Message: SyslogMessage{Name: []byte("app"), Message: []byte("hi")}}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	var out map[string]interface{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatalf("invalid JSON %s (%s)", b, err)
+	}
+	if out["seq"] != float64(42) || out["name"] != "app" || out["message"] != "hi" {
+		t.Errorf("unexpected JSON: %s", b)
+	}
+}
+
+func TestSyslogMessage_KvField(t *testing.T) {
+	msg := SyslogMessage{Message: []byte(`at=error code=H12 desc="Request timeout" status=503 bytes=`)}
+	for key, expected := range map[string]string{"code": "H12", "desc": "Request timeout", "status": "503", "bytes": ""} {
+		if value, ok := fieldString(msg, "kv."+key); !ok || value != expected {
+			t.Errorf("expected kv.%s to be %q, found %q (%v)", key, expected, value, ok)
+		}
+	}
+	if _, ok := msg.Field("kv.path"); ok {
+		t.Errorf("expected kv.path to be missing")
+	}
+}
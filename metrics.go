@@ -0,0 +1,240 @@
+package logflect
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MaxMetricPoints         = 60   // points kept per series
+	MaxMetricSeriesPerDrain = 1000 // new series beyond this are ignored
+)
+
+const (
+	MetricSample  = "sample"
+	MetricCount   = "count"
+	MetricMeasure = "measure"
+)
+
+// A value extracted from a log line.
+type metricValue struct {
+	Kind  string // MetricSample, MetricCount or MetricMeasure
+	Name  string
+	Value float64
+	Unit  string
+}
+
+type metricPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// A time series for one metric from one source (dyno) of a drain. Counts
+// also keep a running total.
+type metricSeries struct {
+	Source string        `json:"source"`
+	Name   string        `json:"name"`
+	Kind   string        `json:"kind"`
+	Unit   string        `json:"unit,omitempty"`
+	Total  float64       `json:"total,omitempty"`
+	Points []metricPoint `json:"points"`
+}
+
+type metricKey struct {
+	source, name, kind string
+}
+
+// Time series extracted from the messages of each drain.
+type metricStore struct {
+	drains map[string]map[metricKey]*metricSeries
+	m      *sync.RWMutex
+}
+
+func newMetricStore() *metricStore {
+	return &metricStore{
+		drains: make(map[string]map[metricKey]*metricSeries),
+		m:      new(sync.RWMutex),
+	}
+}
+
+// Extracts metrics from `msg` following Heroku's logfmt conventions:
+// `sample#`, `count#` and `measure#` prefixed keys, attributed to the
+// `source=` given or the process id, plus the `connect` and `service`
+// times of router lines.
+func parseMetrics(msg Message) (source string, values []metricValue) {
+	text, _ := fieldString(msg, "message")
+	if procid, ok := msg.Field("procid"); ok {
+		if b, ok := procid.([]byte); ok {
+			source = string(b)
+		}
+	}
+	router := source == "router"
+
+	if !router && !strings.Contains(text, "#") {
+		return source, nil
+	}
+
+	scanKV(text, func(key, value string) bool {
+		kind := ""
+		if hash := strings.IndexByte(key, '#'); hash > 0 {
+			switch key[:hash] {
+			case MetricSample, MetricCount, MetricMeasure:
+				kind, key = key[:hash], key[hash+1:]
+			}
+		} else if key == "source" {
+			source = value
+		} else if router && (key == "connect" || key == "service") {
+			kind, key = MetricMeasure, "router."+key
+		}
+
+		if kind != "" && key != "" {
+			if v, unit, ok := parseMetricValue(value); ok {
+				values = append(values, metricValue{Kind: kind, Name: key, Value: v, Unit: unit})
+			}
+		}
+		return true
+	})
+
+	return source, values
+}
+
+// Splits a value like `21.5MB` into its number and unit.
+func parseMetricValue(s string) (float64, string, bool) {
+	end := 0
+	for end < len(s) && (s[end] >= '0' && s[end] <= '9' || s[end] == '.' || s[end] == '-' || s[end] == '+' || s[end] == 'e' && end > 0) {
+		end++
+	}
+	// `e` only counts as an exponent when followed by digits
+	for end > 0 && s[end-1] == 'e' {
+		end--
+	}
+
+	v, err := strconv.ParseFloat(s[:end], 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return v, s[end:], true
+}
+
+// Records any metrics in `msg`, published to `drainId`.
+func (ms *metricStore) record(drainId string, msg Message) {
+	source, values := parseMetrics(msg)
+	if len(values) == 0 {
+		return
+	}
+
+	at, ok := messageTime(msg)
+	if !ok {
+		at = time.Now()
+	}
+
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	series, exists := ms.drains[drainId]
+	if !exists {
+		series = make(map[metricKey]*metricSeries)
+		ms.drains[drainId] = series
+	}
+
+	for _, v := range values {
+		key := metricKey{source, v.Name, v.Kind}
+		s, exists := series[key]
+		if !exists {
+			if len(series) >= MaxMetricSeriesPerDrain {
+				continue
+			}
+			s = &metricSeries{Source: source, Name: v.Name, Kind: v.Kind}
+			series[key] = s
+		}
+
+		s.Unit = v.Unit
+		if v.Kind == MetricCount {
+			s.Total += v.Value
+		}
+		if s.Points = append(s.Points, metricPoint{Time: at, Value: v.Value}); len(s.Points) > MaxMetricPoints {
+			s.Points = s.Points[len(s.Points)-MaxMetricPoints:]
+		}
+	}
+}
+
+// Returns copies of a drain's series, sorted by source and name.
+func (ms *metricStore) Series(drainId string) []metricSeries {
+	ms.m.RLock()
+	defer ms.m.RUnlock()
+
+	series := make([]metricSeries, 0, len(ms.drains[drainId]))
+	for _, s := range ms.drains[drainId] {
+		c := *s
+		c.Points = append([]metricPoint(nil), s.Points...)
+		series = append(series, c)
+	}
+	sortSeries(series)
+	return series
+}
+
+// Writes the latest value of every series in the Prometheus text format.
+// Samples and measures are gauges; counts are counters of their total.
+func (ms *metricStore) WritePrometheus(w io.Writer) error {
+	ms.m.RLock()
+	drainIds := make([]string, 0, len(ms.drains))
+	for drainId := range ms.drains {
+		drainIds = append(drainIds, drainId)
+	}
+	ms.m.RUnlock()
+	sort.Strings(drainIds)
+
+	lines := map[string][]string{}
+	for _, drainId := range drainIds {
+		for _, s := range ms.Series(drainId) {
+			labels := fmt.Sprintf(`drain=%s,source=%s,name=%s,unit=%s`,
+				promQuote(drainId), promQuote(s.Source), promQuote(s.Name), promQuote(s.Unit))
+			switch s.Kind {
+			case MetricCount:
+				lines[s.Kind] = append(lines[s.Kind], fmt.Sprintf("logflect_count_total{%s} %g", labels, s.Total))
+			default:
+				lines[s.Kind] = append(lines[s.Kind], fmt.Sprintf("logflect_%s{%s} %g", s.Kind, labels, s.Points[len(s.Points)-1].Value))
+			}
+		}
+	}
+
+	families := []struct{ kind, name, typ, help string }{
+		{MetricSample, "logflect_sample", "gauge", "Latest sample# value logged by a drain."},
+		{MetricMeasure, "logflect_measure", "gauge", "Latest measure# value logged by a drain."},
+		{MetricCount, "logflect_count_total", "counter", "Total of count# values logged by a drain."},
+	}
+	for _, family := range families {
+		if len(lines[family.kind]) == 0 {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s\n", family.name, family.help,
+			family.name, family.typ, strings.Join(lines[family.kind], "\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortSeries(series []metricSeries) {
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].Source != series[j].Source {
+			return series[i].Source < series[j].Source
+		}
+		if series[i].Name != series[j].Name {
+			return series[i].Name < series[j].Name
+		}
+		return series[i].Kind < series[j].Kind
+	})
+}
+
+// Quotes a Prometheus label value.
+func promQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
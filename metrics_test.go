@@ -0,0 +1,83 @@
+package logflect
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMetrics(t *testing.T) {
+	msg := SyslogMessage{
+		Procid:  []byte("web.1"),
+		Message: []byte("source=web.1 dyno=heroku.123 sample#load_avg_1m=2.46 sample#memory_total=21.00MB count#jobs=3 measure#db.query=12ms note=hi"),
+	}
+
+	source, values := parseMetrics(msg)
+	if source != "web.1" {
+		t.Errorf("unexpected source %q", source)
+	}
+
+	expected := []metricValue{
+		{MetricSample, "load_avg_1m", 2.46, ""},
+		{MetricSample, "memory_total", 21, "MB"},
+		{MetricCount, "jobs", 3, ""},
+		{MetricMeasure, "db.query", 12, "ms"},
+	}
+	if len(values) != len(expected) {
+		t.Fatalf("expected %v, found %v", expected, values)
+	}
+	for i := range expected {
+		if values[i] != expected[i] {
+			t.Errorf("expected %v, found %v", expected[i], values[i])
+		}
+	}
+}
+
+func TestParseMetrics_Router(t *testing.T) {
+	msg := SyslogMessage{
+		Name:    []byte("heroku"),
+		Procid:  []byte("router"),
+		Message: []byte(`at=info method=GET path="/" connect=1ms service=18ms status=200 bytes=13`),
+	}
+
+	source, values := parseMetrics(msg)
+	if source != "router" || len(values) != 2 {
+		t.Fatalf("unexpected metrics %q %v", source, values)
+	}
+	if values[0].Name != "router.connect" || values[1].Name != "router.service" || values[1].Value != 18 {
+		t.Errorf("unexpected metrics %v", values)
+	}
+}
+
+func TestStore_Metrics(t *testing.T) {
+	store := NewStore(time.Hour, time.Hour)
+	for _, line := range []string{"sample#memory_total=20MB count#jobs=2", "sample#memory_total=21MB count#jobs=1"} {
+		store.Publish("drain.id", SyslogMessage{Procid: []byte("web.1"), Message: []byte(line)})
+	}
+	store.Publish("drain.id", StrMessage("no metrics here"))
+
+	series := store.Metrics("drain.id")
+	if len(series) != 2 {
+		t.Fatalf("expected 2 series, found %v", series)
+	}
+	if series[0].Name != "jobs" || series[0].Total != 3 || len(series[0].Points) != 2 {
+		t.Errorf("unexpected count series %+v", series[0])
+	}
+	if series[1].Name != "memory_total" || series[1].Points[1].Value != 21 || series[1].Unit != "MB" {
+		t.Errorf("unexpected sample series %+v", series[1])
+	}
+
+	var buf bytes.Buffer
+	store.WriteMetrics(&buf)
+	out := buf.String()
+	for _, expected := range []string{
+		"# TYPE logflect_sample gauge\n",
+		`logflect_sample{drain="drain.id",source="web.1",name="memory_total",unit="MB"} 21` + "\n",
+		`logflect_count_total{drain="drain.id",source="web.1",name="jobs",unit=""} 3` + "\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %q in %q", expected, out)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package logflect
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	RedactedText = "[REDACTED]"
+	MaskedValue  = "***"
+)
+
+var (
+	ErrInvalidRedact = errors.New("Invalid redaction")
+
+	// Built-in PII detectors, by name.
+	redactDetectors = map[string]*regexp.Regexp{
+		"email": regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+		"card":  regexp.MustCompile(`\b[0-9](?:[ -]?[0-9]){12,18}\b`),
+		"token": regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/-]+=*|\b(?:sk|pk|rk)_(?:live|test)_[A-Za-z0-9]{8,}|\bgh[pousr]_[A-Za-z0-9]{20,}|\bAKIA[0-9A-Z]{16}\b`),
+	}
+)
+
+// Rewrites message text to hide sensitive values: matches of patterns and
+// detectors are replaced with RedactedText, and the values of logfmt keys
+// are masked with MaskedValue. Counts what it hides.
+type redactor struct {
+	patterns []*regexp.Regexp
+	cards    bool           // the card detector, which also checks digits with Luhn
+	keys     *regexp.Regexp // nil unless masking keys
+	request  redactRequest  // as configured, for reporting
+	count    uint64         // values hidden, accessed atomically
+}
+
+func newRedactor(request redactRequest) (*redactor, error) {
+	r := &redactor{request: request}
+
+	for _, pattern := range request.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil || pattern == "" {
+			return nil, ErrInvalidRedact
+		}
+		r.patterns = append(r.patterns, re)
+	}
+
+	for _, name := range request.Detectors {
+		re, exists := redactDetectors[name]
+		if !exists {
+			return nil, ErrInvalidRedact
+		}
+		if name == "card" {
+			r.cards = true
+		} else {
+			r.patterns = append(r.patterns, re)
+		}
+	}
+
+	if len(request.MaskKeys) > 0 {
+		quoted := make([]string, len(request.MaskKeys))
+		for i, key := range request.MaskKeys {
+			if key == "" {
+				return nil, ErrInvalidRedact
+			}
+			quoted[i] = regexp.QuoteMeta(key)
+		}
+		r.keys = regexp.MustCompile(`(^|\s)(` + strings.Join(quoted, "|") + `)=("(?:[^"\\]|\\.)*"|\S*)`)
+	}
+
+	if len(r.patterns) == 0 && !r.cards && r.keys == nil {
+		return nil, ErrInvalidRedact
+	}
+	return r, nil
+}
+
+// Returns `msg` with sensitive values hidden.
+func (r *redactor) Redact(msg Message) Message {
+	return rewriteText(msg, r.redactText)
+}
+
+// Returns the number of values hidden so far.
+func (r *redactor) Count() uint64 {
+	return atomic.LoadUint64(&r.count)
+}
+
+func (r *redactor) redactText(text string) string {
+	var n uint64
+
+	if r.keys != nil {
+		text = r.keys.ReplaceAllStringFunc(text, func(match string) string {
+			n++
+			sub := r.keys.FindStringSubmatch(match)
+			return sub[1] + sub[2] + "=" + MaskedValue
+		})
+	}
+
+	for _, re := range r.patterns {
+		text = re.ReplaceAllStringFunc(text, func(string) string {
+			n++
+			return RedactedText
+		})
+	}
+
+	if r.cards {
+		text = redactDetectors["card"].ReplaceAllStringFunc(text, func(match string) string {
+			if !luhn(match) {
+				return match
+			}
+			n++
+			return RedactedText
+		})
+	}
+
+	if n > 0 {
+		atomic.AddUint64(&r.count, n)
+	}
+	return text
+}
+
+// Validates a card number's check digit, ignoring spaces and dashes.
+func luhn(number string) bool {
+	sum, double := 0, false
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c == ' ' || c == '-' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// Returns `msg` with its text, the syslog message body, rewritten by
+// `fn`. Wrapping messages are rewritten inside, keeping their wrapping.
+func rewriteText(msg Message, fn func(string) string) Message {
+	switch m := msg.(type) {
+	case StrMessage:
+		return StrMessage(fn(string(m)))
+	case SyslogMessage:
+		m.Message = []byte(fn(string(m.Message)))
+		return m
+	case SequencedMessage:
+		m.Message = rewriteText(m.Message, fn)
+		return m
+	case RepeatedMessage:
+		m.Message = rewriteText(m.Message, fn)
+		return m
+	default:
+		return StrMessage(fn(msg.String()))
+	}
+}
@@ -0,0 +1,73 @@
+package logflect
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedactor_Redact(t *testing.T) {
+	r, err := newRedactor(redactRequest{
+		Patterns:  []string{`secret-[0-9]+`},
+		MaskKeys:  []string{"password", "api_key"},
+		Detectors: []string{"email", "card", "token"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	msg := SequencedMessage{Seq: 1, Message: SyslogMessage{
+		Name:    []byte("app"),
+		Message: []byte(`user=bob@example.com password="hunter 2" api_key=abc card=4111 1111 1111 1111 order=1234567890123 auth="Bearer eyJhbGciOi" code=secret-42`),
+	}}
+
+	out := r.Redact(msg).(SequencedMessage)
+	text, _ := fieldString(out, "message")
+	expected := `user=[REDACTED] password=*** api_key=*** card=[REDACTED] order=1234567890123 auth="[REDACTED]" code=[REDACTED]`
+	if text != expected {
+		t.Errorf("expected %q, found %q", expected, text)
+	}
+	if out.Seq != 1 || string(out.Message.(SyslogMessage).Name) != "app" {
+		t.Errorf("expected the rest of the message to be kept, found %v", out)
+	}
+	if r.Count() != 6 {
+		t.Errorf("expected 6 redactions, found %d", r.Count())
+	}
+}
+
+func TestNewRedactor_Invalid(t *testing.T) {
+	for _, request := range []redactRequest{{}, {Patterns: []string{"("}}, {Detectors: []string{"ssn"}}, {MaskKeys: []string{""}}} {
+		if _, err := newRedactor(request); err != ErrInvalidRedact {
+			t.Errorf("expected ErrInvalidRedact for %+v, got %v", request, err)
+		}
+	}
+}
+
+func TestStore_Redact(t *testing.T) {
+	store := NewStore(time.Hour, time.Hour)
+	r, _ := newRedactor(redactRequest{MaskKeys: []string{"token"}})
+	store.SetRedactor("drain.id", r)
+
+	if out := store.Redact("drain.id", StrMessage("token=abc at=info")); out.String() != "token=*** at=info" {
+		t.Errorf("unexpected message %q", out)
+	}
+	if out := store.Redact("other.drain", StrMessage("token=abc")); out.String() != "token=abc" {
+		t.Errorf("expected other drains to be left alone, found %q", out)
+	}
+
+	var buf bytes.Buffer
+	store.WriteMetrics(&buf)
+	if !strings.Contains(buf.String(), `logflect_redactions_total{drain="drain.id"} 1`) {
+		t.Errorf("expected redaction count in %q", buf.String())
+	}
+
+	session := NewSession("drain.id", NoFilter{})
+	session.Redact(r)
+	ch := make(chan Message, 1)
+	session.addChannel(ch)
+	session.Publish(StrMessage("token=xyz"))
+	if out := <-ch; out.String() != "token=***" {
+		t.Errorf("expected session output to be redacted, found %q", out)
+	}
+}
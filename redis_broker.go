@@ -0,0 +1,309 @@
+package logflect
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRedisChannel    = "logflect"
+	RedisDialTimeout       = 5 * time.Second
+	RedisMaxReconnectDelay = 30 * time.Second
+)
+
+var (
+	ErrRedisProtocol = errors.New("Unexpected reply from redis")
+	ErrBrokerClosed  = errors.New("Broker closed")
+)
+
+// A Broker speaking the Redis pub/sub protocol. All events go through a
+// single channel; a dedicated connection subscribes to it and is
+// re-established, with backoff, if it drops.
+type RedisBroker struct {
+	addr     string
+	password string
+	channel  string
+
+	pub       net.Conn // connection used for PUBLISH, dialed on demand
+	pubR      *bufio.Reader
+	pm        *sync.Mutex
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Creates a broker for a `redis://[:password@]host:port` URL.
+func NewRedisBroker(redisUrl, channel string) (*RedisBroker, error) {
+	u, err := url.Parse(redisUrl)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("Invalid redis URL: %q", redisUrl)
+	}
+
+	password := ""
+	if u.User != nil {
+		password, _ = u.User.Password()
+	}
+	if channel == "" {
+		channel = DefaultRedisChannel
+	}
+
+	return &RedisBroker{
+		addr:     u.Host,
+		password: password,
+		channel:  channel,
+		pm:       new(sync.Mutex),
+		closed:   make(chan struct{}),
+	}, nil
+}
+
+func (b *RedisBroker) Publish(ev *BrokerEvent) error {
+	payload, err := ev.encode()
+	if err != nil {
+		return err
+	}
+
+	b.pm.Lock()
+	defer b.pm.Unlock()
+
+	// one retry, on a fresh connection, in case the old one went stale
+	for attempt := 0; attempt < 2; attempt++ {
+		if b.pub == nil {
+			if b.pub, b.pubR, err = b.dial(); err != nil {
+				return err
+			}
+		}
+
+		if err = writeCommand(b.pub, "PUBLISH", b.channel, string(payload)); err == nil {
+			if _, err = readReply(b.pubR); err == nil {
+				return nil
+			}
+		}
+
+		b.pub.Close()
+		b.pub, b.pubR = nil, nil
+	}
+	return err
+}
+
+// Calls `fn` for every event on the channel, until the broker is closed.
+// Returns once the first subscription is established.
+func (b *RedisBroker) Subscribe(fn func(*BrokerEvent)) error {
+	conn, r, err := b.subscribe()
+	if err != nil {
+		return err
+	}
+
+	go b.receive(conn, r, fn)
+	return nil
+}
+
+func (b *RedisBroker) Close() error {
+	b.closeOnce.Do(func() { close(b.closed) })
+
+	b.pm.Lock()
+	defer b.pm.Unlock()
+	if b.pub != nil {
+		err := b.pub.Close()
+		b.pub, b.pubR = nil, nil
+		return err
+	}
+	return nil
+}
+
+// Delivers events from the subscription, resubscribing whenever the
+// connection fails, until the broker is closed.
+func (b *RedisBroker) receive(conn net.Conn, r *bufio.Reader, fn func(*BrokerEvent)) {
+	for conn != nil {
+		err := b.readEvents(conn, r, fn)
+		conn.Close()
+
+		select {
+		case <-b.closed:
+			return
+		default:
+			log.Printf("at=receive in=redis_broker err=%q", err)
+		}
+
+		conn, r = b.resubscribe()
+	}
+}
+
+// Reads events from `conn` until it fails, or the broker is closed.
+func (b *RedisBroker) readEvents(conn net.Conn, r *bufio.Reader, fn func(*BrokerEvent)) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-b.closed:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return err
+		}
+
+		// ["message", channel, payload]
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 3 || parts[0] != "message" {
+			continue
+		}
+
+		payload, _ := parts[2].(string)
+		if ev, err := decodeBrokerEvent([]byte(payload)); err != nil {
+			log.Printf("at=decode in=redis_broker err=%q", err)
+		} else {
+			fn(ev)
+		}
+	}
+}
+
+// Retries subscribing with exponential backoff. Returns a nil connection
+// if the broker is closed first.
+func (b *RedisBroker) resubscribe() (net.Conn, *bufio.Reader) {
+	delay := time.Second
+	for {
+		select {
+		case <-b.closed:
+			return nil, nil
+		case <-time.After(delay):
+		}
+
+		conn, r, err := b.subscribe()
+		if err == nil {
+			return conn, r
+		}
+
+		log.Printf("at=resubscribe in=redis_broker err=%q", err)
+		if delay *= 2; delay > RedisMaxReconnectDelay {
+			delay = RedisMaxReconnectDelay
+		}
+	}
+}
+
+func (b *RedisBroker) subscribe() (net.Conn, *bufio.Reader, error) {
+	conn, r, err := b.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := writeCommand(conn, "SUBSCRIBE", b.channel); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	// ["subscribe", channel, count]
+	if reply, err := readReply(r); err != nil {
+		conn.Close()
+		return nil, nil, err
+	} else if parts, ok := reply.([]interface{}); !ok || len(parts) != 3 || parts[0] != "subscribe" {
+		conn.Close()
+		return nil, nil, ErrRedisProtocol
+	}
+
+	return conn, r, nil
+}
+
+func (b *RedisBroker) dial() (net.Conn, *bufio.Reader, error) {
+	select {
+	case <-b.closed:
+		return nil, nil, ErrBrokerClosed
+	default:
+	}
+
+	conn, err := net.DialTimeout("tcp", b.addr, RedisDialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(conn)
+
+	if b.password != "" {
+		if err := writeCommand(conn, "AUTH", b.password); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		if _, err := readReply(r); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+
+	return conn, r, nil
+}
+
+// Writes a command as a RESP array of bulk strings.
+func writeCommand(w io.Writer, args ...string) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, fmt.Sprintf("*%d\r\n", len(args))...)
+	for _, arg := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n", len(arg))...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// Reads a RESP reply: strings and bulk strings as string, integers as
+// int64, arrays as []interface{} and nil bulk strings or arrays as nil.
+// Error replies are returned as errors.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, ErrRedisProtocol
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, ErrRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, ErrRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		parts := make([]interface{}, n)
+		for i := range parts {
+			if parts[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return parts, nil
+	default:
+		return nil, ErrRedisProtocol
+	}
+}
@@ -0,0 +1,196 @@
+package logflect
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Just enough of redis to exercise PUBLISH and SUBSCRIBE.
+type fakeRedis struct {
+	ln          net.Listener
+	subscribers map[string][]net.Conn
+	m           sync.Mutex
+}
+
+func startFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen (%s)", err)
+	}
+
+	fr := &fakeRedis{ln: ln, subscribers: make(map[string][]net.Conn)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(conn)
+		}
+	}()
+	return fr
+}
+
+func (fr *fakeRedis) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			conn.Close()
+			return
+		}
+
+		args := reply.([]interface{})
+		switch strings.ToUpper(args[0].(string)) {
+		case "SUBSCRIBE":
+			channel := args[1].(string)
+			fr.m.Lock()
+			fr.subscribers[channel] = append(fr.subscribers[channel], conn)
+			fr.m.Unlock()
+			fmt.Fprintf(conn, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(channel), channel)
+		case "PUBLISH":
+			channel, payload := args[1].(string), args[2].(string)
+			fr.m.Lock()
+			for _, sub := range fr.subscribers[channel] {
+				writeCommand(sub, "message", channel, payload)
+			}
+			n := len(fr.subscribers[channel])
+			fr.m.Unlock()
+			fmt.Fprintf(conn, ":%d\r\n", n)
+		default:
+			conn.Write([]byte("-ERR unknown command\r\n"))
+		}
+	}
+}
+
+func (fr *fakeRedis) url() string {
+	return "redis://" + fr.ln.Addr().String()
+}
+
+// Waits for `cond`, failing the test if it doesn't hold within a second.
+func eventually(t *testing.T, what string, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("timed out waiting for %s", what)
+}
+
+func TestReadReply(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader([]byte("*3\r\n$7\r\nmessage\r\n:2\r\n$-1\r\n-ERR nope\r\n")))
+
+	reply, err := readReply(r)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	parts := reply.([]interface{})
+	if parts[0] != "message" || parts[1] != int64(2) || parts[2] != nil {
+		t.Errorf("unexpected reply %v", parts)
+	}
+
+	if _, err := readReply(r); err == nil || err.Error() != "ERR nope" {
+		t.Errorf("expected error reply, found %v", err)
+	}
+}
+
+func TestRedisBroker_SharesMessagesAndSessions(t *testing.T) {
+	fr := startFakeRedis(t)
+	defer fr.ln.Close()
+
+	stores := []*Store{NewStore(time.Hour, time.Hour), NewStore(time.Hour, time.Hour)}
+	for _, store := range stores {
+		broker, err := NewRedisBroker(fr.url(), "")
+		if err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		if err := store.SetBroker(broker); err != nil {
+			t.Fatalf("unable to subscribe (%s)", err)
+		}
+		defer store.Close()
+	}
+
+	request := []byte(`{"drain_id": "d.shared"}`)
+	session, _ := stores[0].CreateSession("d.shared", NoFilter{})
+	if err := stores[0].ShareSession(session, request); err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	eventually(t, "shared session", func() bool {
+		_, exists := stores[1].GetSession(session.Id)
+		return exists
+	})
+
+	stores[0].Publish("d.shared", SyslogMessage{Name: []byte("app"), Message: []byte("hello")})
+	for i, store := range stores {
+		eventually(t, "message on every store", func() bool {
+			feed, exists := store.lookupFeed("d.shared")
+			if !exists {
+				return false
+			}
+			msgs, _, _ := feed.Since(0)
+			return len(msgs) == 1 && string(msgs[0].(SequencedMessage).Message.(SyslogMessage).Message) == "hello"
+		})
+		if t.Failed() {
+			t.Fatalf("store %d missing message", i)
+		}
+	}
+
+	stores[0].DestroySession(session.Id)
+	eventually(t, "shared session destroyed", func() bool {
+		_, exists := stores[1].GetSession(session.Id)
+		return !exists
+	})
+}
+
+func TestRedisBroker_SharesRedactionsAndGroups(t *testing.T) {
+	fr := startFakeRedis(t)
+	defer fr.ln.Close()
+
+	stores := []*Store{NewStore(time.Hour, time.Hour), NewStore(time.Hour, time.Hour)}
+	for _, store := range stores {
+		broker, err := NewRedisBroker(fr.url(), "")
+		if err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		if err := store.SetBroker(broker); err != nil {
+			t.Fatalf("unable to subscribe (%s)", err)
+		}
+		defer store.Close()
+	}
+
+	redactor, _ := newRedactor(redactRequest{Detectors: []string{"email"}})
+	stores[0].SetRedactor("d.shared", redactor)
+	stores[0].SetGroup("web", []string{"d.shared"})
+	eventually(t, "shared redactions and group", func() bool {
+		_, redacted := stores[1].GetRedactor("d.shared")
+		_, grouped := stores[1].GetGroup("web")
+		return redacted && grouped
+	})
+
+	// ingested on the other replica, as the api does
+	msg := SyslogMessage{Message: []byte("signup from jane@example.com")}
+	stores[1].Publish("d.shared", stores[1].Redact("d.shared", msg))
+	eventually(t, "redacted message", func() bool {
+		feed, exists := stores[0].lookupFeed("d.shared")
+		if !exists {
+			return false
+		}
+		msgs, _, _ := feed.Since(0)
+		return len(msgs) == 1 && !strings.Contains(msgs[0].String(), "jane@example.com")
+	})
+
+	stores[0].DeleteRedactor("d.shared")
+	stores[0].DeleteGroup("web")
+	eventually(t, "redactions and group deleted", func() bool {
+		_, redacted := stores[1].GetRedactor("d.shared")
+		_, grouped := stores[1].GetGroup("web")
+		return !redacted && !grouped
+	})
+}
@@ -4,7 +4,11 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var (
@@ -12,11 +16,73 @@ var (
 	ErrInvalidFilterParam = errors.New("Invalid filter parameter")
 	ErrInvalidFilterField = errors.New("Invalid filter field")
 	ErrInvalidFilterType  = errors.New("Invalid filter type")
+	ErrInvalidSearchParam = errors.New("Invalid search parameter")
+	ErrInvalidForward     = errors.New("Invalid forward")
+	ErrInvalidAlert       = errors.New("Invalid alert")
+	ErrInvalidAggregate   = errors.New("Invalid aggregate parameter")
+	ErrInvalidDedupe      = errors.New("Invalid dedupe")
+)
+
+const (
+	DefaultSearchLimit = 100
+	MaxSearchLimit     = MaxFeedCount
 )
 
 type sessionRequest struct {
-	DrainId string          `json:"drain_id"`
-	Filters []sessionFilter `json:"filters,omitempty"`
+	DrainId       string            `json:"drain_id,omitempty"`
+	DrainIds      []string          `json:"drain_ids,omitempty"`
+	DrainGroups   []string          `json:"drain_groups,omitempty"`
+	DrainPatterns []string          `json:"drain_patterns,omitempty"`
+	Filters       []sessionFilter   `json:"filters,omitempty"`
+	Forward       *forwardRequest   `json:"forward,omitempty"`
+	Alert         *alertRequest     `json:"alert,omitempty"`
+	Sample        string            `json:"sample,omitempty"`    // `1/N` or a percentage
+	SampleBy      string            `json:"sample_by,omitempty"` // field sampled on
+	MaxRate       float64           `json:"max_rate,omitempty"`  // lines per second
+	Dedupe        *dedupeRequest    `json:"dedupe,omitempty"`
+	Redact        *redactRequest    `json:"redact,omitempty"`
+	Transform     *transformRequest `json:"transform,omitempty"`
+}
+
+type dedupeRequest struct {
+	Mode   string `json:"mode,omitempty"`   // "exact" (default) or "normalized"
+	Window string `json:"window,omitempty"` // collapse duplicates within the window, not just consecutive ones
+}
+
+type forwardRequest struct {
+	Type          string `json:"type"` // "logplex", "syslog" or "webhook"
+	Url           string `json:"url"`
+	Token         string `json:"token,omitempty"` // the target drain's token, required for "logplex"
+	BatchSize     int    `json:"batch_size,omitempty"`
+	BatchInterval string `json:"batch_interval,omitempty"`
+	MaxRetries    *int   `json:"max_retries,omitempty"`
+}
+
+type alertRequest struct {
+	Url       string `json:"url"`
+	Threshold int    `json:"threshold"`
+	Window    string `json:"window,omitempty"`
+	Cooldown  string `json:"cooldown,omitempty"`
+	Samples   *int   `json:"samples,omitempty"`
+}
+
+// Redactions, for a drain's ingest or a session's output.
+type redactRequest struct {
+	Patterns  []string `json:"patterns,omitempty"`  // regexps
+	MaskKeys  []string `json:"mask_keys,omitempty"` // logfmt keys
+	Detectors []string `json:"detectors,omitempty"` // "email", "card" or "token"
+}
+
+// Reshapes a session's output.
+type transformRequest struct {
+	Select   []string          `json:"select,omitempty"`   // fields to keep, in order
+	Rename   map[string]string `json:"rename,omitempty"`   // field -> output name
+	Compute  map[string]string `json:"compute,omitempty"`  // field -> expression, e.g. "kv.service / 1000"
+	Template string            `json:"template,omitempty"` // text/template over the fields, e.g. "{{.name}}: {{.message}}"
+}
+
+type groupRequest struct {
+	DrainIds []string `json:"drain_ids"`
 }
 
 type sessionFilter struct {
@@ -25,38 +91,457 @@ type sessionFilter struct {
 	Param string `json:"param,omitempty"`
 }
 
-func readSessionRequest(body io.Reader) (string, Filter, error) {
+// A session request, validated.
+type sessionConfig struct {
+	sub       Subscription
+	filter    Filter
+	forward   *forwardConfig // nil unless this is a forward session
+	alert     *alertConfig   // nil unless this is an alert session
+	sampler   *sampler       // nil unless sampling
+	maxRate   float64        // zero for no limit
+	dedupe    *dedupeConfig  // nil unless collapsing duplicates
+	redact    *redactor      // nil unless redacting output
+	transform *transform     // nil unless reshaping output
+}
+
+// Reads a session request: what to subscribe to (`drain_id` followed by
+// any `drain_ids`, without duplicates, plus `drain_groups` and
+// `drain_patterns`), the filter to apply, deduplication, sampling, rate
+// limits, redaction and transforms, and where to forward messages or send
+// alerts.
+func readSessionRequest(body io.Reader) (*sessionConfig, error) {
 	decoder := json.NewDecoder(body)
 	request := sessionRequest{}
 
 	if err := decoder.Decode(&request); err != nil {
-		return "", nil, ErrInvalidRequest
+		return nil, ErrInvalidRequest
 	}
 
-	if request.DrainId == "" {
-		return "", nil, ErrInvalidRequest
+	sub, err := NewSubscription(request.drainIds(), request.DrainGroups, request.DrainPatterns)
+	if err != nil {
+		return nil, err
+	}
+	if sub.Empty() {
+		return nil, ErrInvalidRequest
 	}
 
+	config := &sessionConfig{sub: sub}
+
 	switch len(request.Filters) {
 	case 0:
-		return request.DrainId, NewNoFilter(), nil
+		config.filter = NewNoFilter()
 	case 1:
 		if filter, err := request.Filters[0].ToFilter(); err != nil {
-			return request.DrainId, nil, err
+			return nil, err
 		} else {
-			return request.DrainId, filter, nil
+			config.filter = filter
 		}
 	default:
 		filters := make([]Filter, len(request.Filters))
 		for i := 0; i < len(request.Filters); i++ {
 			if f, err := request.Filters[i].ToFilter(); err != nil {
-				return request.DrainId, nil, err
+				return nil, err
 			} else {
 				filters[i] = f
 			}
 		}
-		return request.DrainId, NewComboFilter(filters...), nil
+		config.filter = NewComboFilter(filters...)
+	}
+
+	if request.Forward != nil {
+		if config.forward, err = request.Forward.toConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	if request.Alert != nil {
+		if config.alert, err = request.Alert.toConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	if request.Sample != "" {
+		if config.sampler, err = newSampler(request.Sample, request.SampleBy); err != nil {
+			return nil, err
+		}
+	}
+
+	if request.MaxRate < 0 {
+		return nil, ErrInvalidRequest
+	}
+	config.maxRate = request.MaxRate
+
+	if request.Dedupe != nil {
+		if config.dedupe, err = request.Dedupe.toConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	if request.Redact != nil {
+		if config.redact, err = newRedactor(*request.Redact); err != nil {
+			return nil, err
+		}
+	}
+
+	if request.Transform != nil {
+		if config.transform, err = newTransform(*request.Transform); err != nil {
+			return nil, err
+		}
+	}
+
+	return config, nil
+}
+
+// Applies the request's stream options to `session`, before any stream
+// is attached.
+func (c *sessionConfig) configure(session *Session) {
+	session.Limit(c.sampler, c.maxRate)
+	if c.dedupe != nil {
+		session.Dedupe(c.dedupe)
+	}
+	if c.redact != nil {
+		session.Redact(c.redact)
+	}
+	if c.transform != nil {
+		session.Transform(c.transform)
+	}
+}
+
+func (sr *sessionRequest) drainIds() []string {
+	seen := make(map[string]bool)
+	drainIds := make([]string, 0, len(sr.DrainIds)+1)
+
+	for _, drainId := range append([]string{sr.DrainId}, sr.DrainIds...) {
+		if drainId != "" && !seen[drainId] {
+			seen[drainId] = true
+			drainIds = append(drainIds, drainId)
+		}
+	}
+	return drainIds
+}
+
+func readRedactRequest(body io.Reader) (*redactor, error) {
+	request := redactRequest{}
+	if err := json.NewDecoder(body).Decode(&request); err != nil {
+		return nil, ErrInvalidRequest
+	}
+	return newRedactor(request)
+}
+
+func readGroupRequest(body io.Reader) ([]string, error) {
+	request := groupRequest{}
+	if err := json.NewDecoder(body).Decode(&request); err != nil {
+		return nil, ErrInvalidRequest
+	}
+
+	for _, drainId := range request.DrainIds {
+		if drainId == "" {
+			return nil, ErrInvalidRequest
+		}
+	}
+	return request.DrainIds, nil
+}
+
+func (fr *forwardRequest) toConfig() (*forwardConfig, error) {
+	config := &forwardConfig{
+		kind:          fr.Type,
+		token:         fr.Token,
+		batchSize:     DefaultForwardBatchSize,
+		batchInterval: DefaultForwardBatchInterval,
+		maxRetries:    DefaultForwardMaxRetries,
+	}
+
+	u, err := url.Parse(fr.Url)
+	if err != nil || u.Host == "" {
+		return nil, ErrInvalidForward
+	}
+	config.url = u
+
+	switch fr.Type {
+	case "logplex", "webhook":
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, ErrInvalidForward
+		}
+		if fr.Type == "logplex" && fr.Token == "" {
+			return nil, ErrInvalidForward
+		}
+	case "syslog":
+		if u.Scheme != "syslog" && u.Scheme != "syslog+tls" {
+			return nil, ErrInvalidForward
+		}
+	default:
+		return nil, ErrInvalidForward
+	}
+
+	if fr.BatchSize < 0 || fr.BatchSize > MaxForwardBatchSize {
+		return nil, ErrInvalidForward
+	} else if fr.BatchSize > 0 {
+		config.batchSize = fr.BatchSize
+	}
+
+	if fr.BatchInterval != "" {
+		d, err := time.ParseDuration(fr.BatchInterval)
+		if err != nil || d <= 0 {
+			return nil, ErrInvalidForward
+		}
+		config.batchInterval = d
+	}
+
+	if fr.MaxRetries != nil {
+		if *fr.MaxRetries < 0 {
+			return nil, ErrInvalidForward
+		}
+		config.maxRetries = *fr.MaxRetries
+	}
+
+	return config, nil
+}
+
+func (ar *alertRequest) toConfig() (*alertConfig, error) {
+	config := &alertConfig{
+		threshold: ar.Threshold,
+		window:    DefaultAlertWindow,
+		cooldown:  DefaultAlertCooldown,
+		samples:   DefaultAlertSamples,
+	}
+
+	u, err := url.Parse(ar.Url)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, ErrInvalidAlert
+	}
+	config.url = u
+
+	if ar.Threshold < 0 {
+		return nil, ErrInvalidAlert
+	}
+
+	if ar.Window != "" {
+		d, err := time.ParseDuration(ar.Window)
+		if err != nil || d <= 0 {
+			return nil, ErrInvalidAlert
+		}
+		config.window = d
+	}
+
+	if ar.Cooldown != "" {
+		d, err := time.ParseDuration(ar.Cooldown)
+		if err != nil || d < 0 {
+			return nil, ErrInvalidAlert
+		}
+		config.cooldown = d
+	}
+
+	if ar.Samples != nil {
+		if *ar.Samples < 0 || *ar.Samples > MaxAlertSamples {
+			return nil, ErrInvalidAlert
+		}
+		config.samples = *ar.Samples
+	}
+
+	return config, nil
+}
+
+func (dr *dedupeRequest) toConfig() (*dedupeConfig, error) {
+	config := &dedupeConfig{}
+
+	switch dr.Mode {
+	case "", "exact":
+	case "normalized":
+		config.normalize = true
+	default:
+		return nil, ErrInvalidDedupe
+	}
+
+	if dr.Window != "" {
+		d, err := time.ParseDuration(dr.Window)
+		if err != nil || d <= 0 {
+			return nil, ErrInvalidDedupe
+		}
+		config.window = d
+	}
+
+	return config, nil
+}
+
+type searchRequest struct {
+	filter      Filter
+	limit       int
+	since       time.Time
+	until       time.Time
+	newestFirst bool
+	cursor      uint64
+	format      formatter
+}
+
+// Reads a search from query parameters. Filters are given as repeated
+// `filter=field:type:param` values, and `since`/`until` accept either an
+// RFC3339 timestamp or a duration relative to now (e.g. `15m`).
+func readSearchRequest(q url.Values, now time.Time) (*searchRequest, error) {
+	request := &searchRequest{
+		limit:       DefaultSearchLimit,
+		newestFirst: true,
+	}
+
+	var err error
+	if request.filter, err = readFilterParams(q["filter"]); err != nil {
+		return nil, err
+	}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return nil, ErrInvalidSearchParam
+		}
+		if limit > MaxSearchLimit {
+			limit = MaxSearchLimit
+		}
+		request.limit = limit
+	}
+
+	if v := q.Get("cursor"); v != "" {
+		cursor, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, ErrInvalidSearchParam
+		}
+		request.cursor = cursor
+	}
+
+	if request.since, err = parseSearchTime(q.Get("since"), now); err != nil {
+		return nil, err
+	}
+	if request.until, err = parseSearchTime(q.Get("until"), now); err != nil {
+		return nil, err
+	}
+
+	switch q.Get("order") {
+	case "", "desc", "newest":
+		request.newestFirst = true
+	case "asc", "oldest":
+		request.newestFirst = false
+	default:
+		return nil, ErrInvalidSearchParam
+	}
+
+	if request.format, err = newFormatter(q.Get("format"), q.Get("tmpl")); err != nil {
+		return nil, err
+	}
+	if v := q.Get("color"); v != "" {
+		color, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, ErrInvalidSearchParam
+		}
+		if color {
+			request.format = colorize(request.format, request.filter)
+		}
+	}
+
+	return request, nil
+}
+
+// Reads filters given as `field:type:param` query parameter values.
+func readFilterParams(values []string) (Filter, error) {
+	filters := make([]Filter, 0, len(values))
+	for _, raw := range values {
+		parts := strings.SplitN(raw, ":", 3)
+		if len(parts) != 3 {
+			return nil, ErrInvalidFilterParam
+		}
+		sf := sessionFilter{Field: parts[0], Type: parts[1], Param: parts[2]}
+		if f, err := sf.ToFilter(); err != nil {
+			return nil, err
+		} else {
+			filters = append(filters, f)
+		}
+	}
+
+	switch len(filters) {
+	case 0:
+		return NewNoFilter(), nil
+	case 1:
+		return filters[0], nil
+	default:
+		return NewComboFilter(filters...), nil
+	}
+}
+
+func parseSearchTime(v string, now time.Time) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, ErrInvalidSearchParam
+}
+
+type aggregateRequest struct {
+	filter Filter
+	by     string        // field to group by; no grouping if empty
+	every  time.Duration // how often to emit
+	over   time.Duration // the window counted
+	sse    bool
+}
+
+// Reads an aggregation from query parameters: `filter`s as for searches,
+// the `by` field, and the `every` and `over` durations.
+func readAggregateRequest(q url.Values) (*aggregateRequest, error) {
+	request := &aggregateRequest{
+		by:    q.Get("by"),
+		every: DefaultAggregateEvery,
+		over:  DefaultAggregateOver,
+	}
+
+	var err error
+	if request.filter, err = readFilterParams(q["filter"]); err != nil {
+		return nil, err
+	}
+
+	if v := q.Get("every"); v != "" {
+		if request.every, err = time.ParseDuration(v); err != nil || request.every < MinAggregateEvery {
+			return nil, ErrInvalidAggregate
+		}
+	}
+	if v := q.Get("over"); v != "" {
+		if request.over, err = time.ParseDuration(v); err != nil {
+			return nil, ErrInvalidAggregate
+		}
+	}
+	if request.over < request.every || request.over > MaxAggregateOver {
+		return nil, ErrInvalidAggregate
+	}
+
+	switch q.Get("format") {
+	case "", "ndjson", "json":
+	case "sse":
+		request.sse = true
+	default:
+		return nil, ErrInvalidFormat
+	}
+
+	return request, nil
+}
+
+// Determines if `m` falls within the request's time bounds. Messages
+// without a timestamp only pass when no bounds are given.
+func (sr *searchRequest) inRange(m Message) bool {
+	if sr.since.IsZero() && sr.until.IsZero() {
+		return true
+	}
+
+	t, ok := messageTime(m)
+	if !ok {
+		return false
+	}
+	if !sr.since.IsZero() && t.Before(sr.since) {
+		return false
+	}
+	if !sr.until.IsZero() && t.After(sr.until) {
+		return false
 	}
+	return true
 }
 
 func (sf *sessionFilter) ToFilter() (Filter, error) {
@@ -2,7 +2,9 @@ package logflect
 
 import (
 	"bytes"
+	"net/url"
 	"testing"
+	"time"
 )
 
 var (
@@ -23,6 +25,12 @@ var (
   ]
 }`
 
+	TestSessionRequest_ValidMultipleDrains = `
+{
+  "drain_id": "d.web",
+  "drain_ids": ["d.api", "d.web", "d.worker"]
+}`
+
 	TestSessionRequest_InvalidMissingType = `
 {
   "drain_id": "a.bad.drain.with.missing.filter.type",
@@ -72,12 +80,13 @@ var (
 
 func TestreadSessionRequest_ValidSingle(t *testing.T) {
 	body := bytes.NewReader([]byte(TestSessionRequest_ValidOne))
-	drainId, filter, err := readSessionRequest(body)
+	config, err := readSessionRequest(body)
 	if err != nil {
-		t.Errorf("unexpected error (%s)", err)
+		t.Fatalf("unexpected error (%s)", err)
 	}
-	if drainId != "a.good.drain.id.with.single.filter" {
-		t.Errorf("unexpected drain id: (%s)", drainId)
+	sub, filter := config.sub, config.filter
+	if len(sub.DrainIds) != 1 || sub.DrainIds[0] != "a.good.drain.id.with.single.filter" {
+		t.Errorf("unexpected drain ids: (%v)", sub.DrainIds)
 	}
 
 	switch filter.(type) {
@@ -90,12 +99,13 @@ func TestreadSessionRequest_ValidSingle(t *testing.T) {
 
 func TestreadSessionRequest_ValidMultiple(t *testing.T) {
 	body := bytes.NewReader([]byte(TestSessionRequest_ValidMultiple))
-	drainId, filter, err := readSessionRequest(body)
+	config, err := readSessionRequest(body)
 	if err != nil {
-		t.Errorf("unexpected error (%s)", err)
+		t.Fatalf("unexpected error (%s)", err)
 	}
-	if drainId != "a.good.drain.id.with.multiple.filters" {
-		t.Errorf("unexpected drain id: (%s)", drainId)
+	sub, filter := config.sub, config.filter
+	if len(sub.DrainIds) != 1 || sub.DrainIds[0] != "a.good.drain.id.with.multiple.filters" {
+		t.Errorf("unexpected drain ids: (%v)", sub.DrainIds)
 	}
 
 	switch filter.(type) {
@@ -106,9 +116,22 @@ func TestreadSessionRequest_ValidMultiple(t *testing.T) {
 	}
 }
 
+func TestReadSessionRequest_ValidMultipleDrains(t *testing.T) {
+	body := bytes.NewReader([]byte(TestSessionRequest_ValidMultipleDrains))
+	config, err := readSessionRequest(body)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	sub := config.sub
+	drainIds := sub.DrainIds
+	if len(drainIds) != 3 || drainIds[0] != "d.web" || drainIds[1] != "d.api" || drainIds[2] != "d.worker" {
+		t.Errorf("unexpected drain ids: (%v)", sub.DrainIds)
+	}
+}
+
 func TestreadSessionRequest_InvalidMissingField(t *testing.T) {
 	body := bytes.NewReader([]byte(TestSessionRequest_InvalidMissingField))
-	_, _, err := readSessionRequest(body)
+	_, err := readSessionRequest(body)
 	if err != ErrInvalidFilterField {
 		t.Errorf("unexpected error (%s)", err)
 	}
@@ -116,7 +139,7 @@ func TestreadSessionRequest_InvalidMissingField(t *testing.T) {
 
 func TestreadSessionRequest_InvalidMissingType(t *testing.T) {
 	body := bytes.NewReader([]byte(TestSessionRequest_InvalidMissingType))
-	_, _, err := readSessionRequest(body)
+	_, err := readSessionRequest(body)
 	if err != ErrInvalidFilterType {
 		t.Errorf("unexpected error (%s)", err)
 	}
@@ -124,7 +147,7 @@ func TestreadSessionRequest_InvalidMissingType(t *testing.T) {
 
 func TestreadSessionRequest_InvalidMissingParam(t *testing.T) {
 	body := bytes.NewReader([]byte(TestSessionRequest_InvalidMissingParam))
-	_, _, err := readSessionRequest(body)
+	_, err := readSessionRequest(body)
 	if err != ErrInvalidFilterParam {
 		t.Errorf("unexpected error (%s)", err)
 	}
@@ -132,7 +155,7 @@ func TestreadSessionRequest_InvalidMissingParam(t *testing.T) {
 
 func TestreadSessionRequest_InvalidMissingDrain(t *testing.T) {
 	body := bytes.NewReader([]byte(TestSessionRequest_InvalidMissingDrain))
-	_, _, err := readSessionRequest(body)
+	_, err := readSessionRequest(body)
 	if err != ErrInvalidRequest {
 		t.Errorf("unexpected error (%s)", err)
 	}
@@ -140,7 +163,7 @@ func TestreadSessionRequest_InvalidMissingDrain(t *testing.T) {
 
 func TestreadSessionRequest_InvalidRegexp(t *testing.T) {
 	body := bytes.NewReader([]byte(TestSessionRequest_InvalidRegexp))
-	_, _, err := readSessionRequest(body)
+	_, err := readSessionRequest(body)
 	if err != ErrInvalidFilterParam {
 		t.Errorf("unexpected error (%s)", err)
 	}
@@ -148,8 +171,124 @@ func TestreadSessionRequest_InvalidRegexp(t *testing.T) {
 
 func TestreadSessionRequest_InvalidJsonBody(t *testing.T) {
 	body := bytes.NewReader([]byte(TestSessionRequest_InvalidJsonBody))
-	_, _, err := readSessionRequest(body)
+	_, err := readSessionRequest(body)
 	if err != ErrInvalidRequest {
 		t.Errorf("unexpected error (%s)", err)
 	}
 }
+
+func TestReadSearchRequest(t *testing.T) {
+	now := time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)
+	q, _ := url.ParseQuery("filter=message:contains:H12&filter=name:regexp:^web&limit=20&since=15m&order=asc&format=ndjson")
+
+	sr, err := readSearchRequest(q, now)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	if _, ok := sr.filter.(ComboFilter); !ok {
+		t.Errorf("Expected ComboFilter, found %v", sr.filter)
+	}
+	if sr.limit != 20 {
+		t.Errorf("unexpected limit: %d", sr.limit)
+	}
+	if !sr.since.Equal(now.Add(-15 * time.Minute)) {
+		t.Errorf("unexpected since: %s", sr.since)
+	}
+	if _, ok := sr.format.(ndjsonFormatter); sr.newestFirst || !ok {
+		t.Errorf("unexpected order/format: %v %T", sr.newestFirst, sr.format)
+	}
+}
+
+func TestReadSearchRequest_Invalid(t *testing.T) {
+	for _, raw := range []string{"filter=message", "limit=0", "cursor=x", "since=yesterday", "order=up", "format=xml"} {
+		q, _ := url.ParseQuery(raw)
+		if _, err := readSearchRequest(q, time.Now()); err == nil {
+			t.Errorf("expected error for %q", raw)
+		}
+	}
+}
+
+func TestSearchRequest_InRange(t *testing.T) {
+	msg := SyslogMessage{Time: []byte("2012-07-22T00:06:26-00:00")}
+	sr := &searchRequest{since: time.Date(2012, 7, 22, 0, 0, 0, 0, time.UTC)}
+	if !sr.inRange(msg) {
+		t.Errorf("message should be after since")
+	}
+
+	sr.until = time.Date(2012, 7, 22, 0, 5, 0, 0, time.UTC)
+	if sr.inRange(msg) {
+		t.Errorf("message should be after until")
+	}
+
+	if sr.inRange(StrMessage("no time")) {
+		t.Errorf("messages without a time shouldn't pass time bounds")
+	}
+}
+
+func TestReadSessionRequest_Alert(t *testing.T) {
+	body := bytes.NewReader([]byte(`{"drain_id": "d.web", "alert": {"url": "https://example.com/hook", "threshold": 20, "window": "1m"}}`))
+	config, err := readSessionRequest(body)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	if config.alert == nil || config.alert.threshold != 20 || config.alert.window != time.Minute || config.alert.cooldown != DefaultAlertCooldown {
+		t.Errorf("unexpected alert config %+v", config.alert)
+	}
+
+	for _, alert := range []string{`{"url": "ftp://example.com"}`, `{"url": "http://example.com", "window": "soon"}`, `{"url": "http://example.com", "threshold": -1}`} {
+		body := bytes.NewReader([]byte(`{"drain_id": "d.web", "alert": ` + alert + `}`))
+		if _, err := readSessionRequest(body); err != ErrInvalidAlert {
+			t.Errorf("expected ErrInvalidAlert for %s, got %v", alert, err)
+		}
+	}
+}
+
+func TestReadAggregateRequest(t *testing.T) {
+	q, _ := url.ParseQuery("filter=message:contains:error&by=kv.status&every=10s&over=5m&format=sse")
+	ar, err := readAggregateRequest(q)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	if ar.by != "kv.status" || ar.every != 10*time.Second || ar.over != 5*time.Minute || !ar.sse {
+		t.Errorf("unexpected request %+v", ar)
+	}
+
+	for _, raw := range []string{"every=10ms", "every=1m&over=10s", "over=2h", "format=xml", "filter=x"} {
+		q, _ := url.ParseQuery(raw)
+		if _, err := readAggregateRequest(q); err == nil {
+			t.Errorf("expected error for %q", raw)
+		}
+	}
+}
+
+func TestReadSessionRequest_Dedupe(t *testing.T) {
+	body := bytes.NewReader([]byte(`{"drain_id": "d.web", "dedupe": {"mode": "normalized", "window": "30s"}}`))
+	config, err := readSessionRequest(body)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	if config.dedupe == nil || !config.dedupe.normalize || config.dedupe.window != 30*time.Second {
+		t.Errorf("unexpected dedupe config %+v", config.dedupe)
+	}
+
+	body = bytes.NewReader([]byte(`{"drain_id": "d.web", "dedupe": {"mode": "fuzzy"}}`))
+	if _, err := readSessionRequest(body); err != ErrInvalidDedupe {
+		t.Errorf("expected ErrInvalidDedupe, got %v", err)
+	}
+}
+
+func TestReadSessionRequest_Transform(t *testing.T) {
+	body := bytes.NewReader([]byte(`{"drain_id": "d.web", "transform": {"select": ["name", "ms"], "compute": {"ms": "kv.service / 1"}}}`))
+	config, err := readSessionRequest(body)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	if config.transform == nil || len(config.transform.computed) != 1 {
+		t.Errorf("unexpected transform %+v", config.transform)
+	}
+
+	body = bytes.NewReader([]byte(`{"drain_id": "d.web", "transform": {"compute": {"ms": "kv.service /"}}}`))
+	if _, err := readSessionRequest(body); err != ErrInvalidExpression {
+		t.Errorf("expected ErrInvalidExpression, got %v", err)
+	}
+}
@@ -16,10 +16,15 @@ func NewServer(h *http.Server, s *Store, shutdownChan chan struct{}) *Server {
 	api := NewApi(s, h)
 	return &Server{
 		api:          api,
+		store:        s,
 		shutdownChan: shutdownChan,
 	}
 }
 
+func (s *Server) SetCluster(c *Cluster) {
+	s.api.SetCluster(c)
+}
+
 func (s *Server) Close() error {
 	log.Printf("at=close in=server")
 	s.shutdownChan <- struct{}{}
@@ -27,14 +32,19 @@ func (s *Server) Close() error {
 }
 
 func (s *Server) Run() {
-	go s.store.Run()
+	s.store.Run()
 	s.api.Run()
 }
 
+// Waits for Close, then shuts down in order: refuse new requests and let
+// in-flight ingest finish, end streaming sessions, and finally close the
+// HTTP listener.
 func (s *Server) Shutdown() {
 	<-s.shutdownChan
 	log.Printf("Shutting down.")
 	s.isShuttingDown = true
-	s.store.Close()
 	s.api.Close()
+	s.store.Close()
+	s.api.Stop()
+	log.Printf("at=shutdown in=server finished=true")
 }
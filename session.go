@@ -4,10 +4,15 @@ import (
 	"crypto/rand"
 	"crypto/sha1"
 	"fmt"
+	"io"
 	"log"
 	mrand "math/rand"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,43 +20,150 @@ const (
 	// TODO: This needs to be tuned.
 	MaxSessionChannelBacklog = 5000
 	MaxSessionAge            = time.Minute
-	ConnectionPingTimeout    = 15 * time.Second
+	ConnectionPingTimeout    = 15 * time.Second // default heartbeat interval
+	MinHeartbeatInterval     = time.Second
 )
 
+// Per-connection statistics, logged when a stream ends.
+type streamStats struct {
+	start     time.Time
+	delivered int
+	reason    string
+}
+
 type Session struct {
 	Id          string
-	DrainId     string
+	DrainId     string   // the first of DrainIds
+	DrainIds    []string // drains the session was explicitly created for
 	filter      Filter
+	deduper     *deduper     // nil unless collapsing duplicates
+	sampler     *sampler     // nil unless sampling
+	limiter     *rateLimiter // nil unless rate limited
+	suppressed  uint64       // messages dropped by the limiter, accessed atomically
+	redactor    *redactor    // nil unless redacting output
+	transform   *transform   // nil unless reshaping output
+	sub         Subscription
+	feeds       map[string]*Feed // attached feeds, which backlog is replayed from on resume
 	inboxes     map[uint32]chan Message
 	lastRemoval time.Time
+	closing     bool // set when the server is shutting down
 	m           *sync.RWMutex
 }
 
 func NewSession(drainId string, f Filter) *Session {
+	return NewMultiSession([]string{drainId}, f)
+}
+
+// Creates a session merging the messages of several drains.
+func NewMultiSession(drainIds []string, f Filter) *Session {
+	return NewSubscribedSession(Subscription{DrainIds: drainIds}, f)
+}
+
+// Creates a session for the drains matched by `sub`. The session still
+// needs to be attached to their feeds, which the Store takes care of.
+func NewSubscribedSession(sub Subscription, f Filter) *Session {
+	var drainId string
+	if len(sub.DrainIds) > 0 {
+		drainId = sub.DrainIds[0]
+	}
+
 	return &Session{
 		Id:          CreateSessionId(),
 		DrainId:     drainId,
+		DrainIds:    sub.DrainIds,
 		filter:      f,
+		sub:         sub,
+		feeds:       make(map[string]*Feed),
 		inboxes:     make(map[uint32]chan Message),
 		lastRemoval: time.Now(),
 		m:           new(sync.RWMutex),
 	}
 }
 
-func (s *Session) Publish(msg Message) bool {
-	if s.filter.Passes(msg) {
+// Samples and rate limits the messages passing the session's filter.
+// Messages over `maxRate` per second are counted, and reported to streams
+// as suppressed. A zero `maxRate` means no limit.
+func (s *Session) Limit(sample *sampler, maxRate float64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.sampler = sample
+	s.limiter = nil
+	if maxRate > 0 {
+		s.limiter = newRateLimiter(maxRate)
+	}
+}
+
+// Collapses duplicate messages passing the session's filter, before they
+// are sampled or rate limited.
+func (s *Session) Dedupe(config *dedupeConfig) {
+	d := newDeduper(config, func(msgs []Message) {
 		s.m.RLock()
 		defer s.m.RUnlock()
-
-		for _, inbox := range s.inboxes {
-			log.Printf("Publishing %s -> %v", msg, inbox)
-			inbox <- msg
+		for _, msg := range msgs {
+			s.deliver(msg)
 		}
-		return true
+	})
+
+	s.m.Lock()
+	old := s.deduper
+	s.deduper = d
+	s.m.Unlock()
+
+	if old != nil {
+		old.stop()
+	}
+}
+
+// Hides sensitive values in the messages the session hands to streams.
+func (s *Session) Redact(r *redactor) {
+	s.m.Lock()
+	s.redactor = r
+	s.m.Unlock()
+}
+
+// Reshapes the messages the session hands to streams, after redaction.
+func (s *Session) Transform(t *transform) {
+	s.m.Lock()
+	s.transform = t
+	s.m.Unlock()
+}
+
+// Hands `msg` to every attached stream. Streams whose inbox is full, e.g.
+// because the client stopped reading, miss the message rather than
+// blocking the feed.
+func (s *Session) Publish(msg Message) bool {
+	if !s.filter.Passes(msg) {
+		return false
+	}
+
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	if s.deduper == nil {
+		s.deliver(msg)
 	} else {
-		log.Printf("Nothing to publish to inbox")
+		for _, m := range s.deduper.admit(msg) {
+			s.deliver(m)
+		}
+	}
+	return true
+}
+
+// Hands `msg` to the streams, if prepare keeps it. Called with s.m held.
+func (s *Session) deliver(msg Message) {
+	msg, ok := s.prepare(msg)
+	if !ok {
+		return
+	}
+
+	for id, inbox := range s.inboxes {
+		select {
+		case inbox <- msg:
+		default:
+			log.Printf("action=drop session_id=%s inbox=%d", s.Id, id)
+		}
 	}
-	return false
 }
 
 func (s *Session) Close() error {
@@ -61,6 +173,13 @@ func (s *Session) Close() error {
 	oldInboxes := s.inboxes
 	s.inboxes = make(map[uint32]chan Message)
 
+	if s.deduper != nil {
+		s.deduper.stop()
+	}
+	if s.redactor != nil && s.redactor.Count() > 0 {
+		log.Printf("action=redactions session_id=%s count=%d", s.Id, s.redactor.Count())
+	}
+
 	// close all the channels
 	for _, inbox := range oldInboxes {
 		close(inbox)
@@ -69,29 +188,255 @@ func (s *Session) Close() error {
 	return nil
 }
 
+// Closes the session, ending streams with a notice that the server is
+// shutting down.
+func (s *Session) Shutdown() error {
+	s.m.Lock()
+	s.closing = true
+	s.m.Unlock()
+
+	return s.Close()
+}
+
+// Streams the session's messages. If `after` (or, for SSE, a Last-Event-ID
+// header) is given, buffered messages from the feeds with a greater sequence
+// number are replayed first, preceded by a gap marker if some of them have
+// already been evicted. The Logflect-Position header gives each feed's last
+// sequence number as the stream started, in the same form as `after`.
+// Sessions on several drains tag each message with its drain and replay
+// their backlogs merged by timestamp.
+//
+// A heartbeat is written whenever the stream has been idle for the
+// `heartbeat` interval, so intermediaries don't close it.
+//
+// The stream ends when the session is closed, the client goes away, or a
+// write fails.
 func (s *Session) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	format, err := newFormatter(query.Get("format"), query.Get("tmpl"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if v := query.Get("color"); v != "" {
+		color, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "Invalid color parameter", http.StatusBadRequest)
+			return
+		}
+		if color {
+			format = colorize(format, s.filter)
+		}
+	}
+	if s.merged() {
+		format = tagDrains(format)
+	}
+
+	resumeFrom := query.Get("after")
+	if resumeFrom == "" {
+		resumeFrom = r.Header.Get("Last-Event-ID")
+	}
+
+	var after map[string]uint64
+	resume := resumeFrom != ""
+	if resume {
+		if after, err = s.parseResume(resumeFrom); err != nil {
+			http.Error(w, "Invalid after parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	interval := ConnectionPingTimeout
+	if v := query.Get("heartbeat"); v != "" {
+		if interval, err = time.ParseDuration(v); err != nil || interval < MinHeartbeatInterval {
+			http.Error(w, "Invalid heartbeat parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
 	ch := make(chan Message, MaxSessionChannelBacklog)
 	id := s.addChannel(ch)
-	defer s.removeChannel(id)
 
+	stats := &streamStats{start: time.Now(), reason: "closed"}
+	defer func() {
+		s.removeChannel(id)
+		log.Printf("action=disconnect session_id=%s inbox=%d duration=%s delivered=%d reason=%s",
+			s.Id, id, time.Since(stats.start), stats.delivered, stats.reason)
+	}()
+
+	heartbeat := time.NewTimer(interval)
+	defer heartbeat.Stop()
+
+	// Rate limited sessions periodically report what they've suppressed.
+	var suppressedTick <-chan time.Time
+	reported := atomic.LoadUint64(&s.suppressed)
+	if s.rateLimited() {
+		ticker := time.NewTicker(SuppressedNoticeInterval)
+		defer ticker.Stop()
+		suppressedTick = ticker.C
+	}
+
+	// Writes via `fn`, flushes, and pushes the next heartbeat back.
+	write := func(fn func(io.Writer) error) bool {
+		if err := fn(w); err != nil {
+			stats.reason = "write_error"
+			return false
+		}
+		w.(http.Flusher).Flush()
+
+		if !heartbeat.Stop() {
+			select {
+			case <-heartbeat.C:
+			default:
+			}
+		}
+		heartbeat.Reset(interval)
+		return true
+	}
+
+	// Where each feed stood once the stream was listening, for clients to
+	// resume drains which stay quiet from.
+	feeds := s.attachedFeeds()
+	position := make([]string, 0, len(feeds))
+	for _, feed := range feeds {
+		position = append(position, feed.DrainId+":"+strconv.FormatUint(feed.Seq(), 10))
+	}
+	w.Header().Set("Logflect-Position", strings.Join(position, ","))
+	w.Header().Set("Content-Type", format.ContentType())
 	w.(http.Flusher).Flush()
 
-	timeout := time.NewTimer(ConnectionPingTimeout)
+	// Messages published while replaying also land in `ch`, so skip
+	// anything that was already replayed.
+	replayed := make(map[string]uint64)
+	if resume {
+		backlogs := make([][]Message, 0, len(feeds))
+		for _, feed := range feeds {
+			drainId := feed.DrainId
+			seq, ok := after[drainId]
+			if !ok {
+				continue
+			}
+
+			backlog, gapFrom, gapTo := feed.Since(seq)
+			if gapTo > 0 {
+				if !write(func(w io.Writer) error { return format.Gap(w, drainId, gapFrom, gapTo) }) {
+					return
+				}
+			}
+			if len(backlog) > 0 {
+				replayed[drainId], _ = messageSeq(backlog[len(backlog)-1])
+				backlogs = append(backlogs, backlog)
+			}
+		}
+
+		for _, msg := range s.replay(mergeByTime(backlogs)) {
+			if !write(func(w io.Writer) error { return format.Message(w, msg) }) {
+				return
+			}
+			stats.delivered++
+		}
+	}
 
 	for {
 		select {
 		case msg, open := <-ch:
-			if open {
-				w.Write([]byte(msg.String() + "\n"))
-				w.(http.Flusher).Flush()
-			} else {
-				break
+			if !open {
+				if s.shuttingDown() {
+					write(func(w io.Writer) error { return format.Notice(w, "server shutting down") })
+					stats.reason = "shutdown"
+				}
+				return
+			}
+			if sm, ok := msg.(SequencedMessage); ok && sm.Seq <= replayed[sm.DrainId] {
+				continue
+			}
+			if !write(func(w io.Writer) error { return format.Message(w, msg) }) {
+				return
+			}
+			stats.delivered++
+		case <-suppressedTick:
+			if total := atomic.LoadUint64(&s.suppressed); total > reported {
+				notice := fmt.Sprintf("suppressed %d lines", total-reported)
+				reported = total
+				if !write(func(w io.Writer) error { return format.Notice(w, notice) }) {
+					return
+				}
+			}
+		case <-heartbeat.C:
+			heartbeat.Reset(interval)
+			if err := format.Heartbeat(w); err != nil {
+				stats.reason = "write_error"
+				return
 			}
-		case <-timeout.C:
-			w.Write([]byte("\n"))
 			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			stats.reason = "client_gone"
+			return
+		}
+	}
+}
+
+// Parses a resume position: either `drain:seq` pairs separated by commas,
+// as used in SSE event ids of multi-drain sessions, or a bare sequence
+// number applying to every drain of the session.
+func (s *Session) parseResume(v string) (map[string]uint64, error) {
+	after := make(map[string]uint64)
+
+	if seq, err := strconv.ParseUint(v, 10, 64); err == nil {
+		for _, drainId := range s.DrainIds {
+			after[drainId] = seq
+		}
+		for _, feed := range s.attachedFeeds() {
+			after[feed.DrainId] = seq
+		}
+		return after, nil
+	}
+
+	for _, pair := range strings.Split(v, ",") {
+		i := strings.LastIndex(pair, ":")
+		if i < 0 {
+			return nil, ErrInvalidRequest
+		}
+		seq, err := strconv.ParseUint(pair[i+1:], 10, 64)
+		if err != nil {
+			return nil, ErrInvalidRequest
+		}
+		after[pair[:i]] = seq
+	}
+	return after, nil
+}
+
+// Merges per-feed backlogs, each already in sequence order, into a single
+// list ordered by message timestamp. Messages without a timestamp sort
+// first, and ties keep feed order.
+func mergeByTime(backlogs [][]Message) []Message {
+	if len(backlogs) == 1 {
+		return backlogs[0]
+	}
+
+	total := 0
+	for _, backlog := range backlogs {
+		total += len(backlog)
+	}
+
+	merged := make([]Message, 0, total)
+	for len(merged) < total {
+		next := -1
+		var nextTime time.Time
+		for i, backlog := range backlogs {
+			if len(backlog) == 0 {
+				continue
+			}
+			t, _ := messageTime(backlog[0])
+			if next < 0 || t.Before(nextTime) {
+				next, nextTime = i, t
+			}
 		}
+		merged = append(merged, backlogs[next][0])
+		backlogs[next] = backlogs[next][1:]
 	}
+	return merged
 }
 
 // Determines if session is stale, i.e., there have been no inboxes in the last `d`
@@ -106,6 +451,119 @@ func (s *Session) Stale(d time.Duration) bool {
 	return true
 }
 
+// Determines if the session's streams may carry messages from several
+// drains.
+func (s *Session) merged() bool {
+	return len(s.DrainIds) > 1 || s.sub.Dynamic()
+}
+
+// Samples, rate limits and rewrites `msg` for streams, reporting whether
+// it's kept. Called with s.m held.
+func (s *Session) prepare(msg Message) (Message, bool) {
+	if s.sampler != nil && !s.sampler.keeps(msg) {
+		return nil, false
+	}
+	if s.limiter != nil && !s.limiter.allow() {
+		atomic.AddUint64(&s.suppressed, 1)
+		return nil, false
+	}
+	return s.rewrite(msg), true
+}
+
+// Runs a stream's replayed backlog through the pipeline live messages take
+// in Publish and deliver. Duplicates are collapsed by a deduper of the
+// stream's own, as the session's tracks the live messages, and runs still
+// open at the end are summarized.
+func (s *Session) replay(backlog []Message) []Message {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	var d *deduper
+	if s.deduper != nil {
+		d = newDeduper(s.deduper.config, nil)
+		d.stopped = true // summarized below, rather than on a timer
+	}
+
+	var out []Message
+	keep := func(msgs ...Message) {
+		for _, msg := range msgs {
+			if msg, ok := s.prepare(msg); ok {
+				out = append(out, msg)
+			}
+		}
+	}
+	for _, msg := range backlog {
+		if !s.filter.Passes(msg) {
+			continue
+		}
+		if d == nil {
+			keep(msg)
+		} else {
+			keep(d.admit(msg)...)
+		}
+	}
+	if d != nil {
+		keep(d.summarize()...)
+	}
+	return out
+}
+
+// Redacts and transforms `msg` for output. Called with s.m held.
+func (s *Session) rewrite(msg Message) Message {
+	if s.redactor != nil {
+		msg = s.redactor.Redact(msg)
+	}
+	if s.transform != nil {
+		msg = s.transform.Apply(msg)
+	}
+	return msg
+}
+
+func (s *Session) rateLimited() bool {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.limiter != nil
+}
+
+func (s *Session) attachFeed(feed *Feed) {
+	s.m.Lock()
+	s.feeds[feed.DrainId] = feed
+	s.m.Unlock()
+}
+
+func (s *Session) detachFeed(drainId string) {
+	s.m.Lock()
+	delete(s.feeds, drainId)
+	s.m.Unlock()
+}
+
+func (s *Session) hasFeed(drainId string) bool {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	_, exists := s.feeds[drainId]
+	return exists
+}
+
+// Returns the attached feeds, ordered by drain id.
+func (s *Session) attachedFeeds() []*Feed {
+	s.m.RLock()
+	feeds := make([]*Feed, 0, len(s.feeds))
+	for _, feed := range s.feeds {
+		feeds = append(feeds, feed)
+	}
+	s.m.RUnlock()
+
+	sort.Slice(feeds, func(i, j int) bool { return feeds[i].DrainId < feeds[j].DrainId })
+	return feeds
+}
+
+func (s *Session) shuttingDown() bool {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.closing
+}
+
 func (s *Session) addChannel(ch chan Message) uint32 {
 	s.m.Lock()
 	defer s.m.Unlock()
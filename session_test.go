@@ -0,0 +1,193 @@
+package logflect
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Serves `session` in the background, returning once a stream is attached.
+func startStream(t *testing.T, session *Session, r *http.Request) (*httptest.ResponseRecorder, chan struct{}) {
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		session.ServeHTTP(w, r)
+		close(done)
+	}()
+
+	for i := 0; i < 100; i++ {
+		session.m.RLock()
+		n := len(session.inboxes)
+		session.m.RUnlock()
+		if n > 0 {
+			return w, done
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("session never attached a stream")
+	return nil, nil
+}
+
+func TestSession_ServeHTTPShutdown(t *testing.T) {
+	store := NewStore(time.Hour, time.Hour)
+	session, _ := store.CreateSession("drain.id", NoFilter{})
+
+	w, done := startStream(t, session, httptest.NewRequest("GET", "/v1/sessions/"+session.Id, nil))
+	store.Publish("drain.id", StrMessage("hello"))
+	store.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("stream didn't end after the store closed")
+	}
+
+	body := w.Body.String()
+	if !strings.Contains(body, "seq=1 hello\n") {
+		t.Errorf("expected message in stream, found %q", body)
+	}
+	if !strings.HasSuffix(body, "logflect: server shutting down\n") {
+		t.Errorf("expected shutdown notice at end of stream, found %q", body)
+	}
+}
+
+func TestSession_ServeHTTPClientGone(t *testing.T) {
+	session := NewSession("drain.id", NoFilter{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest("GET", "/v1/sessions/"+session.Id, nil).WithContext(ctx)
+	_, done := startStream(t, session, r)
+	before := session.lastRemoval
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("stream didn't end after the client went away")
+	}
+
+	if len(session.inboxes) != 0 {
+		t.Errorf("inbox not removed after disconnect")
+	}
+	if !session.lastRemoval.After(before) {
+		t.Errorf("lastRemoval not updated after disconnect")
+	}
+}
+
+func TestSession_ServeHTTPHeartbeat(t *testing.T) {
+	session := NewSession("drain.id", NoFilter{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest("GET", "/v1/sessions/"+session.Id+"?format=ndjson&heartbeat=1s", nil).WithContext(ctx)
+	w, done := startStream(t, session, r)
+
+	time.Sleep(1500 * time.Millisecond)
+	cancel()
+	<-done
+
+	if body := w.Body.String(); body != `{"type":"heartbeat"}`+"\n" {
+		t.Errorf("expected a single JSON heartbeat, found %q", body)
+	}
+}
+
+func TestSession_ServeHTTPInvalidHeartbeat(t *testing.T) {
+	session := NewSession("drain.id", NoFilter{})
+
+	w := httptest.NewRecorder()
+	session.ServeHTTP(w, httptest.NewRequest("GET", "/v1/sessions/"+session.Id+"?heartbeat=1ms", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a too short heartbeat, found %d", w.Code)
+	}
+}
+
+func TestSession_ServeHTTPMultiDrainReplay(t *testing.T) {
+	store := NewStore(time.Hour, time.Hour)
+	store.Publish("d.web", SyslogMessage{Time: []byte("2014-06-01T12:00:01Z"), Message: []byte("web 1")})
+	store.Publish("d.web", SyslogMessage{Time: []byte("2014-06-01T12:00:03Z"), Message: []byte("web 2")})
+	store.Publish("d.worker", SyslogMessage{Time: []byte("2014-06-01T12:00:02Z"), Message: []byte("worker 1")})
+	session, _ := store.CreateMultiSession([]string{"d.web", "d.worker"}, NoFilter{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest("GET", "/v1/sessions/"+session.Id+"?format=sse&after=0", nil).WithContext(ctx)
+	w, done := startStream(t, session, r)
+	cancel()
+	<-done
+
+	ids := []string{}
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, "id: ") {
+			ids = append(ids, line[4:])
+		}
+	}
+	if strings.Join(ids, " ") != "d.web:1 d.worker:1 d.web:2" {
+		t.Errorf("expected replay merged by time, found %v", ids)
+	}
+	if position := w.Header().Get("Logflect-Position"); position != "d.web:2,d.worker:1" {
+		t.Errorf("unexpected position %q", position)
+	}
+}
+
+func TestSession_ParseResume(t *testing.T) {
+	session := NewMultiSession([]string{"d.web", "d.worker"}, NoFilter{})
+
+	after, err := session.parseResume("d.web:12,d.worker:3")
+	if err != nil || after["d.web"] != 12 || after["d.worker"] != 3 {
+		t.Errorf("unexpected resume position %v (%v)", after, err)
+	}
+
+	after, err = session.parseResume("7")
+	if err != nil || after["d.web"] != 7 || after["d.worker"] != 7 {
+		t.Errorf("unexpected resume position %v (%v)", after, err)
+	}
+
+	if _, err = session.parseResume("d.web"); err == nil {
+		t.Errorf("expected error for a drain without a sequence number")
+	}
+}
+
+func TestSession_PublishLimited(t *testing.T) {
+	session := NewSession("drain.id", NoFilter{})
+	session.Limit(nil, 5)
+	ch := make(chan Message, 100)
+	session.addChannel(ch)
+
+	for i := 0; i < 20; i++ {
+		session.Publish(StrMessage("hello"))
+	}
+	if len(ch) != 5 || session.suppressed != 15 {
+		t.Errorf("expected 5 delivered and 15 suppressed, found %d and %d", len(ch), session.suppressed)
+	}
+}
+
+func TestSession_ServeHTTPReplayPipeline(t *testing.T) {
+	store := NewStore(time.Hour, time.Hour)
+	for _, text := range []string{"boom", "boom", "boom", "password hunter2", "last"} {
+		store.Publish("d.web", SyslogMessage{Message: []byte(text)})
+	}
+	session, _ := store.CreateSession("d.web", NoFilter{})
+	session.Dedupe(&dedupeConfig{})
+	redactor, _ := newRedactor(redactRequest{Patterns: []string{"hunter2"}})
+	session.Redact(redactor)
+	session.Limit(nil, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest("GET", "/v1/sessions/"+session.Id+"?after=0", nil).WithContext(ctx)
+	w, done := startStream(t, session, r)
+	cancel()
+	<-done
+
+	body := w.Body.String()
+	if strings.Count(body, "boom") != 2 || !strings.Contains(body, "[repeated 2 times]") {
+		t.Errorf("expected replayed duplicates collapsed, found %q", body)
+	}
+	if strings.Contains(body, "hunter2") || !strings.Contains(body, "password") {
+		t.Errorf("expected replayed messages redacted, found %q", body)
+	}
+	if strings.Contains(body, "last") || session.suppressed != 1 {
+		t.Errorf("expected replay rate limited, found %q and %d suppressed", body, session.suppressed)
+	}
+}
@@ -1,8 +1,15 @@
 package logflect
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,22 +18,54 @@ var (
 )
 
 type Store struct {
+	origin       string // identifies this store's events on the broker
+	broker       Broker
 	feeds        map[string]*Feed
 	sessions     map[string]*Session
+	groups       map[string][]string // drain group name -> drain ids
+	metrics      *metricStore
+	redactors    map[string]*redactor // drain id -> ingest redactions
+	ingest       *ingestStats
+	frames       *frameIds // frame ids of recent batches, to skip retries
 	shutdown     chan struct{}
 	shuttingDown bool
 	mf           *sync.RWMutex
 	ms           *sync.RWMutex
+	mg           *sync.RWMutex
+	mr           *sync.RWMutex
 }
 
 func NewStore(maxFeedAge time.Duration, maxSessionAge time.Duration) *Store {
-	return &Store{
-		shutdown: make(chan struct{}),
-		feeds:    make(map[string]*Feed),
-		sessions: make(map[string]*Session),
-		mf:       new(sync.RWMutex),
-		ms:       new(sync.RWMutex),
+	s := &Store{
+		origin:    CreateSessionId(),
+		broker:    NewLocalBroker(),
+		shutdown:  make(chan struct{}),
+		feeds:     make(map[string]*Feed),
+		sessions:  make(map[string]*Session),
+		groups:    make(map[string][]string),
+		metrics:   newMetricStore(),
+		redactors: make(map[string]*redactor),
+		ingest:    new(ingestStats),
+		frames:    newFrameIds(DefaultFrameIdsPerDrain, DefaultFrameIdTTL),
+		mf:        new(sync.RWMutex),
+		ms:        new(sync.RWMutex),
+		mg:        new(sync.RWMutex),
+		mr:        new(sync.RWMutex),
 	}
+
+	s.broker.Subscribe(s.handleEvent)
+	return s
+}
+
+// Replaces the in-process broker with one shared by other processes, so
+// they see each others' messages and sessions. Must be called before the
+// store is used.
+func (s *Store) SetBroker(b Broker) error {
+	if err := b.Subscribe(s.handleEvent); err != nil {
+		return err
+	}
+	s.broker = b
+	return nil
 }
 
 func (s *Store) GetSession(sessionId string) (*Session, bool) {
@@ -38,19 +77,79 @@ func (s *Store) GetSession(sessionId string) (*Session, bool) {
 }
 
 func (s *Store) CreateSession(drainId string, f Filter) (*Session, error) {
+	return s.CreateMultiSession([]string{drainId}, f)
+}
+
+// Creates a session attached to the feed of every drain in `drainIds`.
+func (s *Store) CreateMultiSession(drainIds []string, f Filter) (*Session, error) {
+	return s.Subscribe(Subscription{DrainIds: drainIds}, f)
+}
+
+// Creates a session attached to the feed of every drain `sub` matches.
+// Sessions subscribing to groups or patterns are also attached to feeds
+// created later on, as drains start sending logs.
+func (s *Store) Subscribe(sub Subscription, f Filter) (*Session, error) {
+	session := NewSubscribedSession(sub, f)
+	return session, s.addSession(session)
+}
+
+func (s *Store) addSession(session *Session) error {
+	sub := session.sub
+
+	// Registered before attaching, so feeds created in the meantime
+	// attach the session themselves.
+	s.ms.Lock()
 	if s.shuttingDown {
-		return nil, ErrShuttingDown
+		s.ms.Unlock()
+		return ErrShuttingDown
 	}
-
-	session := NewSession(drainId, f)
-	feed := s.getFeed(drainId)
 	s.sessions[session.Id] = session
-	feed.Attach(session)
+	s.ms.Unlock()
+
+	for _, drainId := range sub.DrainIds {
+		attach(session, s.getFeed(drainId))
+	}
 
-	return session, nil
+	if sub.Dynamic() {
+		groups := s.groupsSnapshot()
+		for _, feed := range s.feedsSnapshot() {
+			if sub.Matches(feed.DrainId, groups) {
+				attach(session, feed)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Tells other processes sharing the broker about a session, so they can
+// serve it too. `request` is the session request it was created from.
+func (s *Store) ShareSession(session *Session, request []byte) error {
+	return s.broker.Publish(&BrokerEvent{
+		Type:      EventSessionCreate,
+		Origin:    s.origin,
+		SessionId: session.Id,
+		Request:   request,
+	})
 }
 
 func (s *Store) DestroySession(sessionId string) bool {
+	if !s.destroySession(sessionId) {
+		return false
+	}
+
+	err := s.broker.Publish(&BrokerEvent{
+		Type:      EventSessionDestroy,
+		Origin:    s.origin,
+		SessionId: sessionId,
+	})
+	if err != nil {
+		log.Printf("action=share_destroy session_id=%s err=%q", sessionId, err)
+	}
+	return true
+}
+
+func (s *Store) destroySession(sessionId string) bool {
 	// closes the associated channel, and deletes from the store.
 	if session, exists := s.GetSession(sessionId); !exists {
 		return false
@@ -59,26 +158,299 @@ func (s *Store) DestroySession(sessionId string) bool {
 		delete(s.sessions, sessionId)
 		s.ms.Unlock()
 
-		feed := s.getFeed(session.DrainId)
-		feed.Detach(session)
+		for _, feed := range session.attachedFeeds() {
+			feed.Detach(session)
+		}
 		session.Close()
 
 		return true
 	}
 }
 
-func (s *Store) Publish(drainId string, msg Message) {
-	feed := s.getFeed(drainId)
-	feed.Publish(msg)
+// Defines, or redefines, a drain group, on every store sharing the broker.
+// Sessions subscribed to the group are attached to, or detached from,
+// feeds to match its new members.
+func (s *Store) SetGroup(name string, drainIds []string) {
+	s.setGroup(name, drainIds)
+
+	request, _ := json.Marshal(groupRequest{DrainIds: drainIds})
+	s.share(&BrokerEvent{Type: EventGroupSet, Group: name, Request: request})
+}
+
+func (s *Store) setGroup(name string, drainIds []string) {
+	s.mg.Lock()
+	s.groups[name] = drainIds
+	s.mg.Unlock()
+
+	s.resubscribe()
 }
 
-func (s *Store) BulkPublish(drainId string, msgs chan Message) {
-	feed := s.getFeed(drainId)
+func (s *Store) GetGroup(name string) ([]string, bool) {
+	s.mg.RLock()
+	defer s.mg.RUnlock()
+
+	drainIds, exists := s.groups[name]
+	return drainIds, exists
+}
+
+func (s *Store) DeleteGroup(name string) bool {
+	s.share(&BrokerEvent{Type: EventGroupDelete, Group: name})
+	return s.deleteGroup(name)
+}
+
+func (s *Store) deleteGroup(name string) bool {
+	s.mg.Lock()
+	_, exists := s.groups[name]
+	delete(s.groups, name)
+	s.mg.Unlock()
+
+	if exists {
+		s.resubscribe()
+	}
+	return exists
+}
+
+// Sets the redactions applied to a drain's messages as they're ingested,
+// by every store sharing the broker.
+func (s *Store) SetRedactor(drainId string, r *redactor) {
+	s.setRedactor(drainId, r)
+
+	request, _ := json.Marshal(r.request)
+	s.share(&BrokerEvent{Type: EventRedactSet, DrainId: drainId, Request: request})
+}
+
+func (s *Store) setRedactor(drainId string, r *redactor) {
+	s.mr.Lock()
+	s.redactors[drainId] = r
+	s.mr.Unlock()
+}
+
+func (s *Store) GetRedactor(drainId string) (*redactor, bool) {
+	s.mr.RLock()
+	defer s.mr.RUnlock()
+
+	r, exists := s.redactors[drainId]
+	return r, exists
+}
+
+func (s *Store) DeleteRedactor(drainId string) bool {
+	s.share(&BrokerEvent{Type: EventRedactDelete, DrainId: drainId})
+	return s.deleteRedactor(drainId)
+}
+
+func (s *Store) deleteRedactor(drainId string) bool {
+	s.mr.Lock()
+	defer s.mr.Unlock()
+
+	_, exists := s.redactors[drainId]
+	delete(s.redactors, drainId)
+	return exists
+}
+
+// Publishes a change already applied to this store, for the other stores
+// sharing the broker.
+func (s *Store) share(ev *BrokerEvent) {
+	ev.Origin = s.origin
+	if err := s.broker.Publish(ev); err != nil {
+		log.Printf("action=share event=%s err=%q", ev.Type, err)
+	}
+}
+
+// Applies a drain's ingest redactions, if any, to `msg`.
+func (s *Store) Redact(drainId string, msg Message) Message {
+	if r, exists := s.GetRedactor(drainId); exists {
+		return r.Redact(msg)
+	}
+	return msg
+}
+
+// Publishes `msg` via the broker, which hands it back to every store
+// sharing it for delivery to the drain's feed.
+func (s *Store) Publish(drainId string, msg Message) error {
+	return s.broker.Publish(newMessageEvent(s.origin, drainId, msg))
+}
+
+func (s *Store) BulkPublish(drainId string, msgs chan Message) error {
 	for msg := range msgs {
-		feed.Publish(msg)
+		if err := s.Publish(drainId, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Applies an event received from the broker. Session, redaction and group
+// events from this store were already applied when they were published.
+func (s *Store) handleEvent(ev *BrokerEvent) {
+	switch ev.Type {
+	case EventMessage:
+		msg := ev.Msg()
+		s.metrics.record(ev.DrainId, msg)
+		s.getFeed(ev.DrainId).Publish(msg)
+	case EventSessionCreate:
+		if ev.Origin == s.origin {
+			return
+		}
+		if _, exists := s.GetSession(ev.SessionId); exists {
+			return
+		}
+
+		config, err := readSessionRequest(bytes.NewReader(ev.Request))
+		if err != nil {
+			log.Printf("action=shared_session session_id=%s err=%q", ev.SessionId, err)
+			return
+		}
+
+		// forwarding and alerting are left to the origin
+		session := NewSubscribedSession(config.sub, config.filter)
+		session.Id = ev.SessionId
+		config.configure(session)
+		s.addSession(session)
+	case EventSessionDestroy:
+		if ev.Origin != s.origin {
+			s.destroySession(ev.SessionId)
+		}
+	case EventRedactSet:
+		if ev.Origin == s.origin {
+			return
+		}
+		r, err := readRedactRequest(bytes.NewReader(ev.Request))
+		if err != nil {
+			log.Printf("action=shared_redactions drainId=%s err=%q", ev.DrainId, err)
+			return
+		}
+		s.setRedactor(ev.DrainId, r)
+	case EventRedactDelete:
+		if ev.Origin != s.origin {
+			s.deleteRedactor(ev.DrainId)
+		}
+	case EventGroupSet:
+		if ev.Origin == s.origin {
+			return
+		}
+		drainIds, err := readGroupRequest(bytes.NewReader(ev.Request))
+		if err != nil {
+			log.Printf("action=shared_group name=%s err=%q", ev.Group, err)
+			return
+		}
+		s.setGroup(ev.Group, drainIds)
+	case EventGroupDelete:
+		if ev.Origin != s.origin {
+			s.deleteGroup(ev.Group)
+		}
 	}
 }
 
+// Runs a bounded search over the buffered messages of a drain. `next` is
+// the sequence number to pass as the cursor for the following page, or 0
+// if there is nothing more to read.
+func (s *Store) Search(drainId string, sr *searchRequest) (msgs []Message, next uint64) {
+	feed, exists := s.lookupFeed(drainId)
+	if !exists {
+		return nil, 0
+	}
+
+	msgs = make([]Message, 0, sr.limit)
+	feed.Scan(sr.newestFirst, func(m Message) bool {
+		seq, _ := messageSeq(m)
+		if sr.cursor > 0 && ((sr.newestFirst && seq >= sr.cursor) || (!sr.newestFirst && seq <= sr.cursor)) {
+			return true
+		}
+		if !sr.inRange(m) || !sr.filter.Passes(m) {
+			return true
+		}
+		if len(msgs) == sr.limit {
+			next, _ = messageSeq(msgs[len(msgs)-1])
+			return false
+		}
+		msgs = append(msgs, m)
+		return true
+	})
+
+	return msgs, next
+}
+
+// Returns the metric series extracted from a drain's messages.
+func (s *Store) Metrics(drainId string) []metricSeries {
+	return s.metrics.Series(drainId)
+}
+
+// Writes the latest value of every drain's metrics in the Prometheus
+// text format.
+func (s *Store) WriteMetrics(w io.Writer) error {
+	if err := s.metrics.WritePrometheus(w); err != nil {
+		return err
+	}
+	if err := s.ingest.WritePrometheus(w); err != nil {
+		return err
+	}
+
+	s.mr.RLock()
+	drainIds := make([]string, 0, len(s.redactors))
+	for drainId := range s.redactors {
+		drainIds = append(drainIds, drainId)
+	}
+	s.mr.RUnlock()
+	if len(drainIds) == 0 {
+		return nil
+	}
+	sort.Strings(drainIds)
+
+	if _, err := io.WriteString(w, "# HELP logflect_redactions_total Values hidden by a drain's ingest redactions.\n# TYPE logflect_redactions_total counter\n"); err != nil {
+		return err
+	}
+	for _, drainId := range drainIds {
+		if r, exists := s.GetRedactor(drainId); exists {
+			if _, err := fmt.Fprintf(w, "logflect_redactions_total{drain=%s} %d\n", promQuote(drainId), r.Count()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Sets how many Logplex frame ids are remembered per drain, and for how
+// long, to skip batches Logplex retries. Must be called before the store
+// is used.
+func (s *Store) SetFrameIds(size int, ttl time.Duration) {
+	s.frames = newFrameIds(size, ttl)
+}
+
+func (s *Store) acceptBatch(messages int) {
+	atomic.AddUint64(&s.ingest.batches, 1)
+	atomic.AddUint64(&s.ingest.messages, uint64(messages))
+}
+
+func (s *Store) rejectBatch(err error) {
+	switch err {
+	case ErrInvalidContentType:
+		atomic.AddUint64(&s.ingest.badType, 1)
+	case ErrMsgCountMismatch:
+		atomic.AddUint64(&s.ingest.miscounted, 1)
+	case ErrIngestQueueFull:
+		atomic.AddUint64(&s.ingest.queueFull, 1)
+	default:
+		atomic.AddUint64(&s.ingest.garbled, 1)
+	}
+}
+
+func (s *Store) duplicateBatch() {
+	atomic.AddUint64(&s.ingest.duplicates, 1)
+}
+
+func (s *Store) failedMessages(messages int) {
+	atomic.AddUint64(&s.ingest.failed, uint64(messages))
+}
+
+// Like getFeed, but doesn't create the feed if it doesn't exist.
+func (s *Store) lookupFeed(drainId string) (*Feed, bool) {
+	s.mf.RLock()
+	defer s.mf.RUnlock()
+
+	feed, exists := s.feeds[drainId]
+	return feed, exists
+}
+
 func (s *Store) getFeed(drainId string) *Feed {
 	s.mf.RLock()
 
@@ -87,8 +459,13 @@ func (s *Store) getFeed(drainId string) *Feed {
 		s.mf.RUnlock()
 
 		s.mf.Lock()
-		feed = s.addFeed(drainId)
+		var created bool
+		feed, created = s.addFeed(drainId)
 		s.mf.Unlock()
+
+		if created {
+			s.attachSubscribers(feed)
+		}
 	} else {
 		s.mf.RUnlock()
 	}
@@ -96,37 +473,113 @@ func (s *Store) getFeed(drainId string) *Feed {
 	return feed
 }
 
-func (s *Store) addFeed(drainId string) *Feed {
+func (s *Store) addFeed(drainId string) (*Feed, bool) {
 	if feed, exists := s.feeds[drainId]; !exists {
 		feed := NewFeed(drainId, MaxFeedCount, 2*time.Hour)
 		s.feeds[drainId] = feed
-		return feed
+		return feed, true
 	} else {
-		return feed
+		return feed, false
+	}
+}
+
+// Attaches sessions whose groups or patterns match a newly created feed.
+func (s *Store) attachSubscribers(feed *Feed) {
+	groups := s.groupsSnapshot()
+	for _, session := range s.dynamicSessions() {
+		if session.sub.Matches(feed.DrainId, groups) {
+			attach(session, feed)
+		}
+	}
+}
+
+// Reconciles the feeds of group and pattern subscribers with the current
+// group definitions.
+func (s *Store) resubscribe() {
+	groups := s.groupsSnapshot()
+	feeds := s.feedsSnapshot()
+
+	for _, session := range s.dynamicSessions() {
+		for _, feed := range feeds {
+			wanted := session.sub.Matches(feed.DrainId, groups)
+			if has := session.hasFeed(feed.DrainId); wanted && !has {
+				attach(session, feed)
+			} else if !wanted && has {
+				feed.Detach(session)
+				session.detachFeed(feed.DrainId)
+			}
+		}
+	}
+}
+
+func (s *Store) dynamicSessions() []*Session {
+	s.ms.RLock()
+	defer s.ms.RUnlock()
+
+	sessions := make([]*Session, 0)
+	for _, session := range s.sessions {
+		if session.sub.Dynamic() {
+			sessions = append(sessions, session)
+		}
 	}
+	return sessions
+}
+
+func (s *Store) feedsSnapshot() []*Feed {
+	s.mf.RLock()
+	defer s.mf.RUnlock()
+
+	feeds := make([]*Feed, 0, len(s.feeds))
+	for _, feed := range s.feeds {
+		feeds = append(feeds, feed)
+	}
+	return feeds
+}
+
+func (s *Store) groupsSnapshot() map[string][]string {
+	s.mg.RLock()
+	defer s.mg.RUnlock()
+
+	groups := make(map[string][]string, len(s.groups))
+	for name, drainIds := range s.groups {
+		groups[name] = drainIds
+	}
+	return groups
+}
+
+func attach(session *Session, feed *Feed) {
+	session.attachFeed(feed)
+	feed.Attach(session)
 }
 
 func (s *Store) Run() {
 	go s.runReaper()
 }
 
+// Ends all sessions, telling their streams the server is shutting down.
 func (s *Store) Close() error {
 	s.ms.Lock()
 	defer s.ms.Unlock()
+
+	if s.shuttingDown {
+		return nil
+	}
 	s.shuttingDown = true
 
 	for _, session := range s.sessions {
-		session.Close()
+		session.Shutdown()
 	}
 
+	s.mf.Lock()
 	for k, _ := range s.feeds {
 		delete(s.feeds, k)
 	}
+	s.mf.Unlock()
 
-	s.shutdown <- struct{}{}
-	return nil
+	close(s.shutdown)
+	return s.broker.Close()
 }
 
 func (s *Store) runReaper() {
-	///	<-s.shutdown // TODO: this will be done in a select at some point, with a timeout for reaper runs.
+	<-s.shutdown // TODO: this will be done in a select at some point, with a timeout for reaper runs.
 }
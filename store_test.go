@@ -55,3 +55,99 @@ func TestStore_DestroySession(t *testing.T) {
 	}
 
 }
+
+func TestStore_Search(t *testing.T) {
+	store := NewStore(time.Hour, time.Hour)
+	for _, m := range []string{"error 1", "ok 2", "error 3", "error 4"} {
+		store.Publish("some.drain.id", StrMessage(m))
+	}
+
+	sr := &searchRequest{
+		filter:      NewContainsFilter("message", "error"),
+		limit:       2,
+		newestFirst: true,
+	}
+
+	msgs, next := store.Search("some.drain.id", sr)
+	if len(msgs) != 2 || msgs[0].String() != "seq=4 error 4" || msgs[1].String() != "seq=3 error 3" {
+		t.Errorf("unexpected first page: %v", msgs)
+	}
+	if next != 3 {
+		t.Errorf("expected next cursor of 3, found %d", next)
+	}
+
+	sr.cursor = next
+	msgs, next = store.Search("some.drain.id", sr)
+	if len(msgs) != 1 || msgs[0].String() != "seq=1 error 1" {
+		t.Errorf("unexpected second page: %v", msgs)
+	}
+	if next != 0 {
+		t.Errorf("expected no next cursor, found %d", next)
+	}
+
+	if _, exists := store.lookupFeed("other.drain.id"); exists {
+		t.Errorf("lookupFeed created a feed")
+	}
+	if msgs, _ := store.Search("other.drain.id", sr); len(msgs) != 0 {
+		t.Errorf("search of unknown drain returned messages")
+	}
+	if _, exists := store.lookupFeed("other.drain.id"); exists {
+		t.Errorf("Search created a feed for an unknown drain")
+	}
+}
+
+func TestStore_CreateMultiSession(t *testing.T) {
+	store := NewStore(time.Hour, time.Hour)
+	session, err := store.CreateMultiSession([]string{"d.web", "d.worker"}, NoFilter{})
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	for _, drainId := range []string{"d.web", "d.worker"} {
+		if _, exists := store.feeds[drainId].sessions[session.Id]; !exists {
+			t.Errorf("session not attached to %s", drainId)
+		}
+	}
+
+	store.DestroySession(session.Id)
+	for _, drainId := range []string{"d.web", "d.worker"} {
+		if _, exists := store.feeds[drainId].sessions[session.Id]; exists {
+			t.Errorf("session still attached to %s", drainId)
+		}
+	}
+}
+
+func TestStore_SubscribePatternsAndGroups(t *testing.T) {
+	store := NewStore(time.Hour, time.Hour)
+	store.Publish("d.prod-web", StrMessage("existing"))
+	store.SetGroup("team-payments", []string{"d.payments"})
+
+	sub, _ := NewSubscription(nil, []string{"team-payments"}, []string{"d.prod-*"})
+	session, err := store.Subscribe(sub, NoFilter{})
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	if !session.hasFeed("d.prod-web") {
+		t.Errorf("session not attached to existing feed matching pattern")
+	}
+
+	// feeds created after the session was
+	store.Publish("d.prod-worker", StrMessage("new"))
+	store.Publish("d.payments", StrMessage("new"))
+	store.Publish("d.staging-web", StrMessage("new"))
+
+	for _, drainId := range []string{"d.prod-worker", "d.payments"} {
+		if _, exists := store.feeds[drainId].sessions[session.Id]; !exists {
+			t.Errorf("session not attached to new feed %s", drainId)
+		}
+	}
+	if session.hasFeed("d.staging-web") {
+		t.Errorf("session attached to unmatched feed")
+	}
+
+	store.SetGroup("team-payments", []string{"d.staging-web"})
+	if session.hasFeed("d.payments") || !session.hasFeed("d.staging-web") {
+		t.Errorf("session didn't follow group redefinition")
+	}
+}
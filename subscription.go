@@ -0,0 +1,69 @@
+package logflect
+
+import (
+	"errors"
+	"path"
+)
+
+var (
+	ErrInvalidPattern = errors.New("Invalid drain pattern")
+)
+
+// The drains a session is attached to: explicit drain ids, named drain
+// groups and glob patterns over drain ids (e.g. `d.prod-*`). Groups and
+// patterns also match drains which first appear after the session was
+// created.
+type Subscription struct {
+	DrainIds []string
+	Groups   []string
+	Patterns []string
+}
+
+func NewSubscription(drainIds, groups, patterns []string) (Subscription, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return Subscription{}, ErrInvalidPattern
+		}
+	}
+
+	return Subscription{
+		DrainIds: drainIds,
+		Groups:   groups,
+		Patterns: patterns,
+	}, nil
+}
+
+// Determines if the subscription can match drains beyond its explicit ones.
+func (sub Subscription) Dynamic() bool {
+	return len(sub.Groups) > 0 || len(sub.Patterns) > 0
+}
+
+func (sub Subscription) Empty() bool {
+	return len(sub.DrainIds) == 0 && !sub.Dynamic()
+}
+
+// Determines if `drainId` is covered by the subscription, given the
+// current drain group definitions.
+func (sub Subscription) Matches(drainId string, groups map[string][]string) bool {
+	for _, id := range sub.DrainIds {
+		if id == drainId {
+			return true
+		}
+	}
+
+	for _, group := range sub.Groups {
+		for _, id := range groups[group] {
+			if id == drainId {
+				return true
+			}
+		}
+	}
+
+	for _, pattern := range sub.Patterns {
+		if ok, _ := path.Match(pattern, drainId); ok {
+			return true
+		}
+	}
+
+	return false
+}
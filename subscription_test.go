@@ -0,0 +1,26 @@
+package logflect
+
+import "testing"
+
+func TestSubscription_Matches(t *testing.T) {
+	sub, err := NewSubscription([]string{"d.one"}, []string{"team"}, []string{"d.prod-*"})
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	groups := map[string][]string{"team": {"d.two"}}
+
+	for _, drainId := range []string{"d.one", "d.two", "d.prod-api"} {
+		if !sub.Matches(drainId, groups) {
+			t.Errorf("expected %s to match", drainId)
+		}
+	}
+	if sub.Matches("d.staging-api", groups) {
+		t.Errorf("expected d.staging-api not to match")
+	}
+}
+
+func TestNewSubscription_InvalidPattern(t *testing.T) {
+	if _, err := NewSubscription(nil, nil, []string{"d.[prod"}); err != ErrInvalidPattern {
+		t.Errorf("expected ErrInvalidPattern, found %v", err)
+	}
+}
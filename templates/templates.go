@@ -0,0 +1,32 @@
+// Package templates holds the line templates shared by logflect's text
+// streams and `logflect tail`.
+package templates
+
+import (
+	"fmt"
+	"text/template"
+	"time"
+)
+
+// Named templates over a message's fields, usable as a stream's `format`
+// or `tmpl`, or as tail's `-format`.
+var Presets = map[string]string{
+	"heroku":  `{{.time}} {{.name}}[{{.procid}}]: {{.message}}`,
+	"short":   `{{clock .time}} {{.procid}}: {{.message}}`,
+	"raw":     `{{.message}}`,
+	"rfc5424": `{{or .privalversion "-"}} {{or .time "-"}} {{or .hostname "-"}} {{or .name "-"}} {{or .procid "-"}} {{or .msgid "-"}} {{.message}}`,
+}
+
+// Helpers available to templates.
+var Funcs = template.FuncMap{
+	"clock": Clock,
+}
+
+// Shortens an RFC3339 timestamp to the time of day, in UTC.
+func Clock(value interface{}) string {
+	s := fmt.Sprint(value)
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UTC().Format("15:04:05")
+	}
+	return s
+}
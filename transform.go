@@ -0,0 +1,437 @@
+package logflect
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/apg/logflect/templates"
+)
+
+var (
+	ErrInvalidTransform  = errors.New("Invalid transform")
+	ErrInvalidExpression = errors.New("Invalid expression")
+)
+
+// The fields every message offers to transforms, besides `kv.<key>`.
+var transformFields = []string{"seq", "drain_id", "time", "hostname", "name", "procid", "msgid", "message"}
+
+// Reshapes a session's messages for its consumer: computes new fields from
+// expressions, then either renders a template over the fields, or keeps
+// the selected fields under their new names.
+type transform struct {
+	selects  []string          // fields kept, in order; all standard fields if empty
+	rename   map[string]string // field -> output name
+	computed []computedField
+	tmpl     *template.Template // nil unless rendering text
+}
+
+type computedField struct {
+	name string
+	expr expr
+}
+
+// A message reshaped by a transform: either ordered fields, or text
+// rendered from a template.
+type TransformedMessage struct {
+	names  []string
+	values map[string]interface{}
+	text   string
+	isText bool
+}
+
+func newTransform(request transformRequest) (*transform, error) {
+	t := &transform{selects: request.Select, rename: request.Rename}
+
+	names := make([]string, 0, len(request.Compute))
+	for name := range request.Compute {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		e, err := parseExpr(request.Compute[name])
+		if err != nil || name == "" {
+			return nil, ErrInvalidExpression
+		}
+		t.computed = append(t.computed, computedField{name, e})
+	}
+
+	if request.Template != "" {
+		tmpl, err := template.New("transform").Funcs(templates.Funcs).Option("missingkey=zero").Parse(request.Template)
+		if err != nil {
+			return nil, ErrInvalidTransform
+		}
+		t.tmpl = tmpl
+	}
+
+	if len(t.selects) == 0 && len(t.rename) == 0 && len(t.computed) == 0 && t.tmpl == nil {
+		return nil, ErrInvalidTransform
+	}
+	return t, nil
+}
+
+// Returns `msg` reshaped. The sequence number stays on the outside, where
+// streams look for it.
+func (t *transform) Apply(msg Message) Message {
+	out := &TransformedMessage{values: make(map[string]interface{})}
+
+	lookup := func(name string) (interface{}, bool) {
+		if v, exists := out.values[name]; exists {
+			return v, true
+		}
+		return transformField(msg, name)
+	}
+
+	for _, c := range t.computed {
+		if v, ok := c.expr.eval(lookup); ok {
+			out.values[c.name] = v
+		}
+	}
+
+	if t.tmpl != nil {
+		data := templateData(msg)
+		for name, v := range out.values {
+			data[name] = v
+		}
+
+		var buf bytes.Buffer
+		if err := t.tmpl.Execute(&buf, data); err != nil {
+			buf.Reset()
+			buf.WriteString(err.Error())
+		}
+		out.text, out.isText = buf.String(), true
+		out.values = nil
+	} else {
+		selects := t.selects
+		if len(selects) == 0 {
+			selects = append(append([]string{}, transformFields[2:]...), t.computedNames()...)
+		}
+		values := make(map[string]interface{}, len(selects))
+		for _, name := range selects {
+			v, ok := lookup(name)
+			if !ok {
+				continue
+			}
+			if renamed, exists := t.rename[name]; exists {
+				name = renamed
+			}
+			out.names = append(out.names, name)
+			values[name] = v
+		}
+		out.values = values
+	}
+
+	if sm, ok := msg.(SequencedMessage); ok {
+		sm.Message = out
+		return sm
+	}
+	return out
+}
+
+func (t *transform) computedNames() []string {
+	names := make([]string, len(t.computed))
+	for i, c := range t.computed {
+		names[i] = c.name
+	}
+	return names
+}
+
+// Looks up a field for a transform, as a string (or number, for `seq`).
+func transformField(msg Message, name string) (interface{}, bool) {
+	if name == "seq" || name == "drain_id" {
+		if sm, ok := msg.(SequencedMessage); ok {
+			if name == "seq" {
+				return sm.Seq, true
+			}
+			return sm.DrainId, true
+		}
+		return nil, false
+	}
+
+	// plain messages only have a body
+	inner := msg
+	if sm, ok := msg.(SequencedMessage); ok {
+		inner = sm.Message
+	}
+	if _, ok := inner.(StrMessage); ok && name != "message" && !strings.HasPrefix(name, "kv.") {
+		return nil, false
+	}
+
+	if value, ok := fieldString(msg, name); ok {
+		return value, true
+	}
+	return nil, false
+}
+
+// Returns the fields of `msg` for templates, with `kv` holding its logfmt
+// pairs. Fields a message doesn't have are empty.
+func templateData(msg Message) map[string]interface{} {
+	data := make(map[string]interface{})
+	for _, name := range append([]string{"privalversion"}, transformFields...) {
+		if v, ok := transformField(msg, name); ok {
+			data[name] = v
+		} else {
+			data[name] = ""
+		}
+	}
+
+	kv := make(map[string]string)
+	if text, ok := fieldString(msg, "message"); ok {
+		scanKV(text, func(k, v string) bool {
+			kv[k] = v
+			return true
+		})
+	}
+	data["kv"] = kv
+	return data
+}
+
+func (m *TransformedMessage) Field(f string) (interface{}, bool) {
+	if m.isText {
+		if f == "message" || f == "Message" {
+			return m.text, true
+		}
+		return nil, false
+	}
+	v, ok := m.values[f]
+	return v, ok
+}
+
+// Renders templated text as is, and fields as logfmt.
+func (m *TransformedMessage) String() string {
+	if m.isText {
+		return m.text
+	}
+
+	parts := make([]string, len(m.names))
+	for i, name := range m.names {
+		value := fmt.Sprint(m.values[name])
+		if value == "" || strings.ContainsAny(value, " \"=") {
+			value = strconv.Quote(value)
+		}
+		parts[i] = name + "=" + value
+	}
+	return strings.Join(parts, " ")
+}
+
+// Renders fields as a JSON object in order, and templated text as a
+// `message`.
+func (m *TransformedMessage) MarshalJSON() ([]byte, error) {
+	if m.isText {
+		return json.Marshal(map[string]string{"message": m.text})
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, name := range m.names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(name)
+		value, err := json.Marshal(m.values[name])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// An arithmetic expression over message fields, e.g. `kv.service / 1000`.
+// Fields in arithmetic use their leading number, so `18ms` counts as 18.
+type expr interface {
+	eval(lookup func(string) (interface{}, bool)) (interface{}, bool)
+}
+
+type fieldExpr string
+
+type numberExpr float64
+
+type stringExpr string
+
+type binaryExpr struct {
+	op          byte
+	left, right expr
+}
+
+func (e fieldExpr) eval(lookup func(string) (interface{}, bool)) (interface{}, bool) {
+	return lookup(string(e))
+}
+
+func (e numberExpr) eval(func(string) (interface{}, bool)) (interface{}, bool) {
+	return float64(e), true
+}
+
+func (e stringExpr) eval(func(string) (interface{}, bool)) (interface{}, bool) {
+	return string(e), true
+}
+
+func (e binaryExpr) eval(lookup func(string) (interface{}, bool)) (interface{}, bool) {
+	lv, lok := e.left.eval(lookup)
+	rv, rok := e.right.eval(lookup)
+	if !lok || !rok {
+		return nil, false
+	}
+
+	l, lnum := exprNumber(lv)
+	r, rnum := exprNumber(rv)
+	if !lnum || !rnum {
+		if e.op == '+' {
+			return fmt.Sprint(lv) + fmt.Sprint(rv), true
+		}
+		return nil, false
+	}
+
+	switch e.op {
+	case '+':
+		return l + r, true
+	case '-':
+		return l - r, true
+	case '*':
+		return l * r, true
+	default:
+		if r == 0 {
+			return nil, false
+		}
+		return l / r, true
+	}
+}
+
+func exprNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case uint64:
+		return float64(n), true
+	case string:
+		f, _, ok := parseMetricValue(n)
+		return f, ok
+	default:
+		return 0, false
+	}
+}
+
+// Parses an expression of fields, numbers, double quoted strings, `+ - * /`
+// and parentheses.
+func parseExpr(s string) (expr, error) {
+	p := &exprParser{tokens: tokenizeExpr(s)}
+	if p.tokens == nil {
+		return nil, ErrInvalidExpression
+	}
+	e, err := p.sum()
+	if err != nil || p.pos != len(p.tokens) {
+		return nil, ErrInvalidExpression
+	}
+	return e, nil
+}
+
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) sum() (expr, error) {
+	left, err := p.product()
+	for err == nil && (p.peek() == "+" || p.peek() == "-") {
+		op := p.tokens[p.pos][0]
+		p.pos++
+		var right expr
+		if right, err = p.product(); err == nil {
+			left = binaryExpr{op, left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) product() (expr, error) {
+	left, err := p.operand()
+	for err == nil && (p.peek() == "*" || p.peek() == "/") {
+		op := p.tokens[p.pos][0]
+		p.pos++
+		var right expr
+		if right, err = p.operand(); err == nil {
+			left = binaryExpr{op, left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) operand() (expr, error) {
+	token := p.peek()
+	p.pos++
+
+	switch {
+	case token == "(":
+		e, err := p.sum()
+		if err != nil || p.peek() != ")" {
+			return nil, ErrInvalidExpression
+		}
+		p.pos++
+		return e, nil
+	case token == "" || strings.ContainsAny(token[:1], "+-*/)"):
+		return nil, ErrInvalidExpression
+	case token[0] == '"':
+		s, err := strconv.Unquote(token)
+		if err != nil {
+			return nil, ErrInvalidExpression
+		}
+		return stringExpr(s), nil
+	case token[0] >= '0' && token[0] <= '9' || token[0] == '.':
+		f, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, ErrInvalidExpression
+		}
+		return numberExpr(f), nil
+	default:
+		return fieldExpr(token), nil
+	}
+}
+
+// Splits an expression into tokens, returning nil if it's malformed.
+func tokenizeExpr(s string) []string {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case strings.IndexByte("+-*/()", c) >= 0:
+			tokens = append(tokens, s[i:i+1])
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(s) && (s[j] != '"' || s[j-1] == '\\') {
+				j++
+			}
+			if j == len(s) {
+				return nil
+			}
+			tokens = append(tokens, s[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for j < len(s) && strings.IndexByte(" \t+-*/()\"", s[j]) < 0 {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,112 @@
+package logflect
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseExpr(t *testing.T) {
+	fields := map[string]interface{}{"kv.service": "18ms", "kv.bytes": "2048", "name": "router"}
+	lookup := func(name string) (interface{}, bool) {
+		v, ok := fields[name]
+		return v, ok
+	}
+
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"kv.service / 1", 18.0},
+		{"kv.bytes / 1024 + 1", 3.0},
+		{"(kv.bytes - 48) * 2", 4000.0},
+		{`name + "." + kv.service`, "router.18ms"},
+	}
+
+	for _, test := range tests {
+		e, err := parseExpr(test.expr)
+		if err != nil {
+			t.Fatalf("unexpected error for %q (%s)", test.expr, err)
+		}
+		if v, ok := e.eval(lookup); !ok || v != test.expected {
+			t.Errorf("expected %q to be %v, found %v", test.expr, test.expected, v)
+		}
+	}
+
+	for _, s := range []string{"", "kv.bytes /", "(kv.bytes", `"open`, "1 2", "* 2"} {
+		if _, err := parseExpr(s); err != ErrInvalidExpression {
+			t.Errorf("expected ErrInvalidExpression for %q, got %v", s, err)
+		}
+	}
+
+	e, _ := parseExpr("kv.missing / 2")
+	if _, ok := e.eval(lookup); ok {
+		t.Errorf("expected a missing field not to evaluate")
+	}
+}
+
+func TestTransform_ApplyFields(t *testing.T) {
+	tr, err := newTransform(transformRequest{
+		Select:  []string{"name", "service_ms", "message"},
+		Rename:  map[string]string{"name": "app"},
+		Compute: map[string]string{"service_ms": "kv.service / 1"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	msg := SequencedMessage{Seq: 7, DrainId: "d.web", Message: SyslogMessage{
+		Hostname: []byte("host"),
+		Name:     []byte("router"),
+		Message:  []byte("at=info service=18ms"),
+	}}
+
+	out := tr.Apply(msg)
+	sm, ok := out.(SequencedMessage)
+	if !ok || sm.Seq != 7 {
+		t.Fatalf("expected the sequence number to be kept, found %#v", out)
+	}
+
+	b, _ := json.Marshal(sm.Message)
+	expected := `{"app":"router","service_ms":18,"message":"at=info service=18ms"}`
+	if string(b) != expected {
+		t.Errorf("expected %s, found %s", expected, b)
+	}
+
+	expected = `app=router service_ms=18 message="at=info service=18ms"`
+	if s := sm.Message.String(); s != expected {
+		t.Errorf("expected %q, found %q", expected, s)
+	}
+}
+
+func TestTransform_ApplyTemplate(t *testing.T) {
+	tr, err := newTransform(transformRequest{Template: "{{.hostname}} {{.name}}: {{.kv.status}} {{.message}}"})
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	out := tr.Apply(SyslogMessage{
+		Hostname: []byte("host"),
+		Name:     []byte("router"),
+		Message:  []byte("status=200 path=/"),
+	})
+
+	expected := "host router: 200 status=200 path=/"
+	if s := out.String(); s != expected {
+		t.Errorf("expected %q, found %q", expected, s)
+	}
+	if v, _ := out.Field("message"); v != expected {
+		t.Errorf("expected the text as the message, found %v", v)
+	}
+}
+
+func TestNewTransform_Invalid(t *testing.T) {
+	if _, err := newTransform(transformRequest{}); err != ErrInvalidTransform {
+		t.Errorf("expected ErrInvalidTransform, got %v", err)
+	}
+	if _, err := newTransform(transformRequest{Template: "{{.name"}); err != ErrInvalidTransform {
+		t.Errorf("expected ErrInvalidTransform, got %v", err)
+	}
+	if _, err := newTransform(transformRequest{Compute: map[string]string{"x": "1 +"}}); err != ErrInvalidExpression {
+		t.Errorf("expected ErrInvalidExpression, got %v", err)
+	}
+}